@@ -1,12 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
-	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Dimdim28/lab4-software-architecture/datastore"
 	"github.com/Dimdim28/lab4-software-architecture/httptools"
@@ -14,26 +16,64 @@ import (
 )
 
 var (
-	port = flag.Int("port", 8100, "server port")
-	db   *datastore.Db
+	port         = flag.Int("port", 8100, "server port")
+	indexStep    = flag.Int("index-step", 0, "keep every n-th key of sealed segments in memory until they are merged, 0 keeps all keys")
+	maxKeySize   = flag.Int("max-key-size", 1<<10, "max key size in bytes")
+	maxValueSize = flag.Int64("max-value-size", 64<<20, "max value size in bytes")
+	maxFormSize  = flag.Int64("max-form-size", 1<<20, "max size of form and JSON bodies in bytes, raw values are streamed up to max-value-size")
+	respPort     = flag.Int("resp-port", 6379, "port of the Redis protocol listener, 0 disables it")
+	shutdownWait = flag.Duration("shutdown-timeout", 10*time.Second, "how long the requests in flight are waited for on shutdown")
+	streamWait   = flag.Duration("stream-timeout", 10*time.Minute, "how long streaming a value in or out may take, other requests time out after 10s")
+	db           *datastore.Db
 )
 
 func main() {
 	flag.Parse()
+	opts := []datastore.Option{
+		datastore.MaxKeySize(*maxKeySize),
+		datastore.MaxValueSize(*maxValueSize),
+	}
+	if *indexStep > 0 {
+		opts = append(opts, datastore.SparseIndex(*indexStep))
+	}
+
 	var err error
-	db, err = datastore.NewDb("./out")
+	db, err = datastore.NewDb("./out", opts...)
 	if err != nil {
 		panic(err)
 	}
-	startServer()
+	registerMetrics()
+	server := startServer()
+	var resp *respServer
+	if *respPort > 0 {
+		if resp, err = startRespServer(*respPort); err != nil {
+			panic(err)
+		}
+	}
 	signal.WaitForTerminationSignal()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownWait)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown: %s", err)
+	}
+	if resp != nil {
+		if err := resp.Shutdown(ctx); err != nil {
+			log.Printf("RESP server shutdown: %s", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Closing the database failed: %s", err)
+	}
 }
 
-func startServer() {
+func startServer() httptools.Server {
 	handler := http.NewServeMux()
+	handler.HandleFunc("/db", handleRange)
 	handler.HandleFunc("/db/", handleDb)
 	server := httptools.CreateServer(*port, handler)
 	server.Start()
+	return server
 }
 
 func handleDb(rw http.ResponseWriter, r *http.Request) {
@@ -41,6 +81,10 @@ func handleDb(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		t := r.URL.Query().Get("type")
+		if r.Header.Get("Accept") == "application/octet-stream" && (t == "" || t == "string") {
+			streamValue(rw, key)
+			return
+		}
 		switch t {
 		case "", "string":
 			data, err := getString(key)
@@ -49,33 +93,106 @@ func handleDb(rw http.ResponseWriter, r *http.Request) {
 			data, err := getInt64(key)
 			sendResponse(rw, data, err)
 		default:
-			http.Error(rw, "ERROR! Unknown data type", http.StatusBadRequest)
+			sendError(rw, errUnknownType)
 		}
+	case http.MethodPut:
+		putStream(rw, r, key)
 	case http.MethodPost:
-		t := r.URL.Query().Get("type")
-		value := r.FormValue("value")
+		if streamable(r) {
+			putStream(rw, r, key)
+			return
+		}
+		value, t, err := readValue(rw, r)
+		if err != nil {
+			sendError(rw, err)
+			return
+		}
+		existed, err := db.Exists(key)
+		if err != nil {
+			sendError(rw, err)
+			return
+		}
 		switch t {
 		case "", "string":
 			err := putString(key, value)
-			sendResponse(rw, nil, err)
+			sendWritten(rw, existed, err)
 		case "int64":
 			err := putInt64(key, value)
-			sendResponse(rw, nil, err)
+			sendWritten(rw, existed, err)
 		default:
-			http.Error(rw, "ERROR! Unknown data type", http.StatusBadRequest)
+			sendError(rw, errUnknownType)
+		}
+	case http.MethodDelete:
+		deleted, err := db.Delete(key)
+		if err == nil && !deleted {
+			err = datastore.ErrNotFound
 		}
+		if err != nil {
+			sendError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
 	default:
-		http.Error(rw, "ERROR! Method not allowed", http.StatusMethodNotAllowed)
+		sendError(rw, errMethodNotAllowed)
+	}
+}
+
+func handleRange(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(rw, errMethodNotAllowed)
+		return
 	}
+	query := r.URL.Query()
+	keys, err := db.Range(query.Get("start"), query.Get("end"))
+	if keys == nil {
+		keys = []string{}
+	}
+	sendResponse(rw, struct {
+		Keys []string `json:"keys"`
+	}{keys}, err)
 }
 
-func sendResponse(rw http.ResponseWriter, data interface{}, err error) {
+// streamValue writes the raw value to the response without loading it into memory.
+func streamValue(rw http.ResponseWriter, key string) {
+	value, size, err := db.GetStream(key)
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
-	} else if data != nil {
-		if err := json.NewEncoder(rw).Encode(data); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-		}
+		sendError(rw, err)
+		return
+	}
+	defer value.Close()
+
+	extendDeadlines(rw)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	rw.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(rw, value); err != nil {
+		log.Printf("Failed to stream %s: %s", key, err)
+	}
+}
+
+// putStream saves the raw body of r under key without loading it into memory.
+func putStream(rw http.ResponseWriter, r *http.Request, key string) {
+	extendDeadlines(rw)
+	existed, err := db.Exists(key)
+	if err == nil {
+		err = db.PutStream(key, requestBody{r.Body}, r.ContentLength)
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = errIncompleteBody
+	}
+	sendWritten(rw, existed, err)
+}
+
+// extendDeadlines gives a request streaming a value the stream timeout
+// instead of the ones of the server.
+func extendDeadlines(rw http.ResponseWriter) {
+	rc := http.NewResponseController(rw)
+	deadline := time.Now().Add(*streamWait)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		log.Printf("Failed to extend the read deadline: %s", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		log.Printf("Failed to extend the write deadline: %s", err)
 	}
 }
 
@@ -103,7 +220,7 @@ func getInt64(key string) (interface{}, error) {
 
 func putString(key, value string) error {
 	if value == "" {
-		return fmt.Errorf("ERROR! Can't save empty value")
+		return errEmptyValue
 	}
 	return db.Put(key, value)
 }
@@ -111,7 +228,7 @@ func putString(key, value string) error {
 func putInt64(key, value string) error {
 	i, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
-		return fmt.Errorf("ERROR! Can't convert value to the given type")
+		return errInvalidValue
 	}
 	return db.PutInt64(key, i)
 }
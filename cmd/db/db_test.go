@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowReader reads the data in chunks with a pause before each of them.
+type slowReader struct {
+	data  []byte
+	chunk int
+	pause time.Duration
+	left  int // bytes left in the current chunk
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if r.left == 0 {
+		time.Sleep(r.pause)
+		r.left = r.chunk
+	}
+	if len(p) > r.left {
+		p = p[:r.left]
+	}
+	n := copy(p, r.data)
+	r.data, r.left = r.data[n:], r.left-n
+	return n, nil
+}
+
+func TestHandleDb_Stream(t *testing.T) {
+	openTestDb(t)
+	saved := *streamWait
+	*streamWait = 5 * time.Second
+	defer func() { *streamWait = saved }()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handleDb))
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	value := bytes.Repeat([]byte("0123456789abcdef"), 1<<19) // 8 MiB
+	t.Run("Slow upload", func(t *testing.T) {
+		body := &slowReader{data: value, chunk: len(value) / 5, pause: 50 * time.Millisecond}
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/db/big", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = int64(len(value))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("ERROR! The upload was cut off: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Errorf("ERROR!\nExpected: %d;\nGot: %d", http.StatusCreated, resp.StatusCode)
+		}
+	})
+
+	t.Run("Slow download", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/db/big", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		time.Sleep(300 * time.Millisecond) // the server blocks on the full socket meanwhile
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("ERROR! The download was cut off: %s", err)
+		}
+		if !bytes.Equal(data, value) {
+			t.Errorf("ERROR! Got %d bytes instead of %d", len(data), len(value))
+		}
+	})
+}
+
+func TestHandleDb_Post(t *testing.T) {
+	openTestDb(t)
+	saved := *maxFormSize
+	*maxFormSize = 1 << 10
+	defer func() { *maxFormSize = saved }()
+
+	post := func(contentType, query string, body []byte) int {
+		r := httptest.NewRequest(http.MethodPost, "/db/key"+query, bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		rw := httptest.NewRecorder()
+		handleDb(rw, r)
+		return rw.Code
+	}
+
+	value := bytes.Repeat([]byte("a"), 4<<10)
+	t.Run("Raw value is streamed", func(t *testing.T) {
+		if code := post("text/plain", "", value); code != http.StatusCreated {
+			t.Fatalf("ERROR!\nExpected: %d;\nGot: %d", http.StatusCreated, code)
+		}
+		got, err := db.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(value) {
+			t.Errorf("ERROR! Got %d bytes instead of %d", len(got), len(value))
+		}
+	})
+
+	cases := []struct {
+		name, contentType, query string
+	}{
+		{"Large JSON", "application/json", ""},
+		{"Large form", "application/x-www-form-urlencoded", ""},
+		{"Large raw int64", "text/plain", "?type=int64"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if code := post(c.contentType, c.query, value); code != http.StatusRequestEntityTooLarge {
+				t.Errorf("ERROR!\nExpected: %d;\nGot: %d", http.StatusRequestEntityTooLarge, code)
+			}
+		})
+	}
+}
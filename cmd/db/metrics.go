@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/Dimdim28/lab4-software-architecture/metrics"
+)
+
+var respCommandsTotal = metrics.NewCounterVec("db_resp_commands_total",
+	"Commands served by the RESP listener.", "command")
+
+func registerMetrics() {
+	metrics.NewGaugeFunc("db_segments", "Segments of the datastore.", func() float64 {
+		return float64(db.Stats().Segments)
+	})
+	metrics.NewGaugeFunc("db_size_bytes", "Bytes in the segments of the datastore.", func() float64 {
+		return float64(db.Stats().Size)
+	})
+	metrics.NewCounterFunc("db_merges_total", "Merges of the datastore segments.", func() float64 {
+		return float64(db.Stats().Merges)
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/Dimdim28/lab4-software-architecture/datastore"
+)
+
+// formOverhead is the room left for the other form fields.
+const formOverhead = 4 << 10
+
+// mediaType returns the media type of the body of r. A body without a
+// content type is taken as is.
+func mediaType(r *http.Request) (string, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return "application/octet-stream", nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", errUnsupportedMediaType
+	}
+	return mediaType, nil
+}
+
+// streamable tells if the body of r is a raw string value, which is saved
+// with PutStream instead of being read by readValue.
+func streamable(r *http.Request) bool {
+	switch r.URL.Query().Get("type") {
+	case "", "string":
+	default:
+		return false
+	}
+	mediaType, err := mediaType(r)
+	return err == nil && (mediaType == "text/plain" || mediaType == "application/octet-stream")
+}
+
+// readValue reads the value to save and its type from the body of r. The body
+// may be a form with the value field, a JSON object like
+// {"value": ..., "type": ...} or the raw value as text/plain or
+// application/octet-stream. The type query parameter is used when the body
+// doesn't carry the type itself. The body is read into memory, so it may not
+// be larger than max-form-size.
+func readValue(rw http.ResponseWriter, r *http.Request) (string, string, error) {
+	t := r.URL.Query().Get("type")
+
+	if r.ContentLength > *maxFormSize {
+		return "", "", datastore.ErrValueTooLarge
+	}
+	r.Body = http.MaxBytesReader(rw, r.Body, *maxFormSize)
+
+	mediaType, err := mediaType(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch mediaType {
+	case "application/json":
+		return readJSONValue(r.Body, t)
+	case "text/plain", "application/octet-stream":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", "", badRequest(err)
+		}
+		return string(data), t, nil
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		err := r.ParseMultipartForm(formOverhead)
+		if err != nil && err != http.ErrNotMultipart {
+			return "", "", badRequest(err)
+		}
+		return r.FormValue("value"), t, nil
+	default:
+		return "", "", errUnsupportedMediaType
+	}
+}
+
+// requestBody marks errors of reading the body, so they are not taken
+// for failures of the datastore.
+type requestBody struct {
+	io.Reader
+}
+
+func (b requestBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = badRequest(err)
+	}
+	return n, err
+}
+
+func readJSONValue(body io.Reader, t string) (string, string, error) {
+	var request struct {
+		Value interface{} `json:"value"`
+		Type  string      `json:"type"`
+	}
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	err := decoder.Decode(&request)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return "", "", err
+	}
+	if err != nil {
+		return "", "", errInvalidJSON
+	}
+	if request.Type != "" {
+		t = request.Type
+	}
+
+	switch value := request.Value.(type) {
+	case string:
+		return value, t, nil
+	case json.Number:
+		return value.String(), t, nil
+	case nil:
+		return "", t, nil
+	default:
+		return "", "", errInvalidValue
+	}
+}
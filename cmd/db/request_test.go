@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadValue(t *testing.T) {
+	cases := []struct {
+		name, contentType, body, query string
+		value, vType                   string
+		err                            error
+	}{
+		{"form", "application/x-www-form-urlencoded", "value=abc", "", "abc", "", nil},
+		{"form with type", "application/x-www-form-urlencoded", "value=12", "?type=int64", "12", "int64", nil},
+		{"no content type", "", "12", "?type=int64", "12", "int64", nil},
+		{"json string", "application/json", `{"value": "abc"}`, "", "abc", "", nil},
+		{"json number", "application/json; charset=utf-8", `{"value": 42, "type": "int64"}`, "", "42", "int64", nil},
+		{"json type overrides query", "application/json", `{"value": 1, "type": "int64"}`, "?type=string", "1", "int64", nil},
+		{"json object value", "application/json", `{"value": {"a": 1}}`, "", "", "", errInvalidValue},
+		{"broken json", "application/json", `{"value": `, "", "", "", errInvalidJSON},
+		{"plain text", "text/plain", "raw value", "", "raw value", "", nil},
+		{"octet stream", "application/octet-stream", "\x00\x01", "?type=string", "\x00\x01", "string", nil},
+		{"unsupported", "image/png", "x", "", "", "", errUnsupportedMediaType},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/db/key"+c.query, strings.NewReader(c.body))
+			if c.contentType != "" {
+				r.Header.Set("Content-Type", c.contentType)
+			}
+			value, vType, err := readValue(httptest.NewRecorder(), r)
+			if err != c.err {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if value != c.value || vType != c.vType {
+				t.Errorf("Unexpected value %q of type %q", value, vType)
+			}
+		})
+	}
+}
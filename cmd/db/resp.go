@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dimdim28/lab4-software-architecture/datastore"
+)
+
+// maxRespArgs limits the number of arguments of a single command.
+const maxRespArgs = 1024
+
+var errRespProtocol = errors.New("Protocol error")
+
+// respServer serves a subset of the Redis protocol (RESP2) backed by db.
+type respServer struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+}
+
+func startRespServer(port int) (*respServer, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	log.Println("RESP listener started on port", port)
+	s := &respServer{listener: l, conns: make(map[net.Conn]struct{})}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("RESP accept failed: %s", err)
+				continue
+			}
+			s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		serveResp(conn)
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+}
+
+// Shutdown stops accepting connections and lets the open ones finish the
+// commands they sent, the connections left when ctx is done are closed.
+func (s *respServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now()) // wakes up the idle connections
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func serveResp(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	w := respWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(in)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				w.error("ERR " + err.Error())
+				w.Flush()
+			}
+			return
+		}
+		quit := len(args) > 0 && execute(w, args)
+		if in.Buffered() == 0 || quit { // replies of pipelined commands go out together
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent either as an array of bulk strings or inline.
+func readCommand(in *bufio.Reader) ([]string, error) {
+	line, err := readLine(in)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxRespArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRespProtocol)
+	}
+	var args []string
+	for i := 0; i < n; i++ {
+		line, err := readLine(in)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errRespProtocol, line)
+		}
+		size, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 || size > *maxValueSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRespProtocol)
+		}
+		// the buffer grows with the data received, not the declared length
+		var data strings.Builder
+		_, err = io.CopyN(&data, in, size+2)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		arg, ok := strings.CutSuffix(data.String(), "\r\n")
+		if !ok {
+			return nil, fmt.Errorf("%w: bulk string is not terminated", errRespProtocol)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func readLine(in *bufio.Reader) (string, error) {
+	line, err := in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w respWriter) error(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w respWriter) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w respWriter) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w respWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w respWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// dbError replies with the Redis flavour of a datastore error.
+func (w respWriter) dbError(err error) {
+	switch {
+	case errors.Is(err, datastore.ErrWrongType):
+		w.error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	case errors.Is(err, datastore.ErrOverflow):
+		w.error("ERR increment or decrement would overflow")
+	case errors.Is(err, datastore.ErrKeyTooLarge), errors.Is(err, datastore.ErrValueTooLarge):
+		w.error("ERR " + err.Error())
+	case errors.Is(err, datastore.ErrReadOnly):
+		w.error("READONLY " + err.Error())
+	default:
+		log.Printf("RESP command failed: %s", err)
+		w.error("ERR internal error")
+	}
+}
+
+type respCommand struct {
+	minArgs, maxArgs int // including the command name, maxArgs < 0 means unlimited
+	run              func(w respWriter, args []string)
+}
+
+var respCommands = map[string]respCommand{
+	"PING":   {1, 2, respPing},
+	"QUIT":   {1, 1, func(w respWriter, _ []string) { w.simple("OK") }},
+	"GET":    {2, 2, respGet},
+	"SET":    {3, 3, respSet},
+	"DEL":    {2, -1, respDel},
+	"EXISTS": {2, -1, respExists},
+	"INCRBY": {3, 3, respIncrBy},
+	"EXPIRE": {3, 3, respExpire},
+	"SCAN":   {2, 6, respScan},
+}
+
+// execute runs the command and reports whether the connection should be closed.
+func execute(w respWriter, args []string) bool {
+	name := strings.ToUpper(args[0])
+	cmd, ok := respCommands[name]
+	if !ok {
+		w.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	respCommandsTotal.With(strings.ToLower(name)).Inc()
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	cmd.run(w, args[1:])
+	return name == "QUIT"
+}
+
+func respPing(w respWriter, args []string) {
+	if len(args) == 1 {
+		w.bulk(args[0])
+		return
+	}
+	w.simple("PONG")
+}
+
+func respGet(w respWriter, args []string) {
+	value, err := db.Get(args[0])
+	if errors.Is(err, datastore.ErrWrongType) { // int64 values are sent as decimal strings
+		var n int64
+		n, err = db.GetInt64(args[0])
+		value = strconv.FormatInt(n, 10)
+	}
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		w.null()
+	case err != nil:
+		w.dbError(err)
+	default:
+		w.bulk(value)
+	}
+}
+
+func respSet(w respWriter, args []string) {
+	err := db.Put(args[0], args[1])
+	if err != nil {
+		w.dbError(err)
+		return
+	}
+	w.simple("OK")
+}
+
+func respDel(w respWriter, args []string) {
+	var n int64
+	for _, key := range args {
+		deleted, err := db.Delete(key)
+		if err != nil {
+			w.dbError(err)
+			return
+		}
+		if deleted {
+			n++
+		}
+	}
+	w.integer(n)
+}
+
+func respExists(w respWriter, args []string) {
+	var n int64
+	for _, key := range args {
+		ok, err := db.Exists(key)
+		if err != nil {
+			w.dbError(err)
+			return
+		}
+		if ok {
+			n++
+		}
+	}
+	w.integer(n)
+}
+
+func respIncrBy(w respWriter, args []string) {
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		w.error("ERR value is not an integer or out of range")
+		return
+	}
+	n, err := db.IncrBy(args[0], delta)
+	if errors.Is(err, datastore.ErrWrongType) {
+		w.error("ERR value is not an integer or out of range")
+		return
+	}
+	if err != nil {
+		w.dbError(err)
+		return
+	}
+	w.integer(n)
+}
+
+func respExpire(w respWriter, args []string) {
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || seconds > int64(math.MaxInt64/time.Second) {
+		w.error("ERR invalid expire time in 'expire' command")
+		return
+	}
+	ttl := time.Duration(0) // a negative ttl removes the key like Redis does
+	if seconds > 0 {
+		ttl = time.Duration(seconds) * time.Second
+	}
+	ok, err := db.Expire(args[0], ttl)
+	if err != nil {
+		w.dbError(err)
+		return
+	}
+	if ok {
+		w.integer(1)
+	} else {
+		w.integer(0)
+	}
+}
+
+const defaultScanCount = 10
+
+// respScan walks the keys in order. Redis clients expect numeric cursors,
+// so the key a scan continues from is kept in scanCursors.
+func respScan(w respWriter, args []string) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	start, ok := scanCursors.get(cursor)
+	if err != nil || !ok {
+		w.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				w.error("ERR syntax error")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	var keys []string
+	var next uint64
+	scanned := 0
+	err = db.Scan(start, func(key string) bool {
+		if scanned == count {
+			next = scanCursors.add(key)
+			return false
+		}
+		scanned++
+		if matchPattern(pattern, key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		w.dbError(err)
+		return
+	}
+
+	w.array(2)
+	w.bulk(strconv.FormatUint(next, 10))
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+}
+
+// maxScanCursors limits the number of remembered cursors, the oldest ones
+// are forgotten first.
+const maxScanCursors = 4096
+
+var scanCursors = &cursorTable{keys: make(map[uint64]string)}
+
+// cursorTable maps cursors to the keys scans continue from, 0 is reserved
+// for the start and the end of a scan.
+type cursorTable struct {
+	mu   sync.Mutex
+	last uint64
+	keys map[uint64]string
+}
+
+func (t *cursorTable) add(key string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.last++
+	t.keys[t.last] = key
+	delete(t.keys, t.last-maxScanCursors)
+	return t.last
+}
+
+func (t *cursorTable) get(cursor uint64) (string, bool) {
+	if cursor == 0 {
+		return "", true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key, ok := t.keys[cursor]
+	return key, ok
+}
+
+// matchPattern reports whether s matches the Redis glob pattern with *, ?,
+// [abc], [^a-z] and \ escapes.
+func matchPattern(pattern, s string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				if s == "" || s[0] != '[' {
+					return false
+				}
+				break
+			}
+			if s == "" || !matchClass(pattern[1:end+1], s[0]) {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func matchClass(class string, c byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			i += 2
+			continue
+		}
+		matched = matched || class[i] == c
+	}
+	return matched != negate
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dimdim28/lab4-software-architecture/datastore"
+)
+
+func openTestDb(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-resp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = datastore.NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+}
+
+// respExchange sends raw commands and returns the raw replies.
+func respExchange(t *testing.T, request string, replies int) string {
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveResp(server)
+
+	go client.Write([]byte(request))
+	in := bufio.NewReader(client)
+	var out strings.Builder
+	for i := 0; i < replies; i++ {
+		readReply(t, in, &out)
+	}
+	return out.String()
+}
+
+func readReply(t *testing.T, in *bufio.Reader, out *strings.Builder) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.WriteString(line)
+	var n int
+	switch line[0] {
+	case '$':
+		fmt.Sscanf(line, "$%d", &n)
+		if n >= 0 {
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(in, data); err != nil {
+				t.Fatal(err)
+			}
+			out.Write(data)
+		}
+	case '*':
+		fmt.Sscanf(line, "*%d", &n)
+		for i := 0; i < n; i++ {
+			readReply(t, in, out)
+		}
+	}
+}
+
+func TestResp(t *testing.T) {
+	openTestDb(t)
+	cases := []struct {
+		name     string
+		request  string
+		expected string
+	}{
+		{"ping", "*1\r\n$4\r\nPING\r\n", "+PONG\r\n"},
+		{"inline", "ping hello\r\n", "$5\r\nhello\r\n"},
+		{"set", "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nva\r\nl\r\n", "+OK\r\n"},
+		{"get", "*2\r\n$3\r\nget\r\n$3\r\nkey\r\n", "$5\r\nva\r\nl\r\n"},
+		{"get missing", "*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n", "$-1\r\n"},
+		{"incrby", "INCRBY counter 5\r\n", ":5\r\n"},
+		{"incrby again", "INCRBY counter -7\r\n", ":-2\r\n"},
+		{"get int64", "GET counter\r\n", "$2\r\n-2\r\n"},
+		{"incrby string", "INCRBY key 1\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"exists", "EXISTS key counter missing key\r\n", ":3\r\n"},
+		{"expire", "EXPIRE key 100\r\n", ":1\r\n"},
+		{"expire missing", "EXPIRE missing 100\r\n", ":0\r\n"},
+		{"expire now", "EXPIRE counter -1\r\n", ":1\r\n"},
+		{"del", "DEL key counter missing\r\n", ":1\r\n"},
+		{"unknown", "FLUSHALL\r\n", "-ERR unknown command 'FLUSHALL'\r\n"},
+		{"arity", "GET\r\n", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"protocol", "*1\r\n+GET\r\n", "-ERR Protocol error: expected '$', got '+'\r\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := respExchange(t, c.request, 1); got != c.expected {
+				t.Errorf("Unexpected reply: %q, expected %q", got, c.expected)
+			}
+		})
+	}
+}
+
+func TestReadCommand_BulkLength(t *testing.T) {
+	// a declared length close to the value limit with a few bytes sent
+	request := fmt.Sprintf("*2\r\n$%d\r\nabc", *maxValueSize)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readCommand(bufio.NewReader(strings.NewReader(request)))
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error: %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Reading the header of a bulk string allocated %d bytes", allocated)
+	}
+
+	args, err := readCommand(bufio.NewReader(strings.NewReader("*1\r\n$3\r\nabcd\r\n")))
+	if err == nil || !errors.Is(err, errRespProtocol) {
+		t.Errorf("Unexpected result: %q, %v, expected a protocol error", args, err)
+	}
+}
+
+func TestRespPipeline(t *testing.T) {
+	openTestDb(t)
+	got := respExchange(t, "SET a 1\r\nINCRBY a 1\r\nGET a\r\n", 3)
+	if expected := "+OK\r\n:2\r\n$1\r\n2\r\n"; got != expected {
+		t.Errorf("Unexpected replies: %q, expected %q", got, expected)
+	}
+}
+
+func TestRespScan(t *testing.T) {
+	openTestDb(t)
+	var expected []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("key:%02d", i)
+		db.Put(key, "value")
+		expected = append(expected, key)
+	}
+	var got []string
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("Scan doesn't finish")
+		}
+		client, server := net.Pipe()
+		go serveResp(server)
+		go fmt.Fprintf(client, "SCAN %s COUNT 13\r\n", cursor)
+		var reply strings.Builder
+		readReply(t, bufio.NewReader(client), &reply)
+		client.Close()
+
+		lines := strings.Split(reply.String(), "\r\n")
+		cursor = lines[2]
+		for i := 5; i < len(lines); i += 2 {
+			got = append(got, lines[i])
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Unexpected keys: %v", got)
+	}
+
+	if reply := respExchange(t, "SCAN 12345 COUNT 1\r\n", 1); reply != "-ERR invalid cursor\r\n" {
+		t.Errorf("Unexpected reply: %q", reply)
+	}
+	reply := respExchange(t, "SCAN 0 MATCH key:1? COUNT 100\r\n", 1)
+	if !strings.HasPrefix(reply, "*2\r\n$1\r\n0\r\n*10\r\n$6\r\nkey:10\r\n") {
+		t.Errorf("Unexpected reply: %q", reply)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		matched    bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"*:[0-9]", "a:b:7", true},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+	}
+	for _, c := range cases {
+		if matchPattern(c.pattern, c.s) != c.matched {
+			t.Errorf("Unexpected result for %q and %q", c.pattern, c.s)
+		}
+	}
+}
+
+func TestRespServer_Shutdown(t *testing.T) {
+	openTestDb(t)
+	s, err := startRespServer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	in := bufio.NewReader(client)
+	client.Write([]byte("PING\r\n"))
+	if reply, _ := in.ReadString('\n'); reply != "+PONG\r\n" {
+		t.Fatalf("Unexpected reply: %q", reply)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %s", err)
+	}
+	if _, err := in.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", s.listener.Addr().String()); err == nil {
+		t.Errorf("Expected new connections to be refused")
+	}
+}
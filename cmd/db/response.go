@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Dimdim28/lab4-software-architecture/datastore"
+)
+
+// apiError is an error reported to the client with its HTTP status and a
+// stable code clients can rely on instead of the message.
+type apiError struct {
+	status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+var (
+	errUnknownType          = &apiError{http.StatusBadRequest, "unknown_type", "unknown data type"}
+	errEmptyValue           = &apiError{http.StatusBadRequest, "empty_value", "can't save empty value"}
+	errInvalidValue         = &apiError{http.StatusBadRequest, "invalid_value", "can't convert value to the given type"}
+	errInvalidJSON          = &apiError{http.StatusBadRequest, "invalid_json", "can't parse JSON body"}
+	errIncompleteBody       = &apiError{http.StatusBadRequest, "incomplete_body", "body is shorter than its content length"}
+	errMethodNotAllowed     = &apiError{http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed"}
+	errUnsupportedMediaType = &apiError{http.StatusUnsupportedMediaType, "unsupported_media_type", "unsupported content type"}
+)
+
+// toAPIError maps errors of the datastore to the errors reported to the client.
+// Errors the client can't be blamed for are reported as internal ones.
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case err == datastore.ErrNotFound:
+		return &apiError{http.StatusNotFound, "not_found", err.Error()}
+	case err == datastore.ErrWrongType:
+		return &apiError{http.StatusConflict, "wrong_type", err.Error()}
+	case err == datastore.ErrKeyTooLarge, err == datastore.ErrValueTooLarge, errors.As(err, &maxBytesErr):
+		return &apiError{http.StatusRequestEntityTooLarge, "too_large", err.Error()}
+	case err == datastore.ErrReadOnly:
+		return &apiError{http.StatusServiceUnavailable, "read_only", err.Error()}
+	}
+	log.Printf("Internal error: %s", err)
+	return &apiError{http.StatusInternalServerError, "internal", err.Error()}
+}
+
+// badRequest marks an error caused by a malformed request.
+func badRequest(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return &apiError{http.StatusBadRequest, "bad_request", err.Error()}
+}
+
+func sendError(rw http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(apiErr.status)
+	_ = json.NewEncoder(rw).Encode(struct {
+		Error *apiError `json:"error"`
+	}{apiErr})
+}
+
+func sendResponse(rw http.ResponseWriter, data interface{}, err error) {
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(data)
+}
+
+// sendWritten answers a successful write with 201 if the key was created
+// and with 204 if an existing value was replaced.
+func sendWritten(rw http.ResponseWriter, existed bool, err error) {
+	switch {
+	case err != nil:
+		sendError(rw, err)
+	case existed:
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.WriteHeader(http.StatusCreated)
+	}
+}
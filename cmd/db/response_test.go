@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Dimdim28/lab4-software-architecture/datastore"
+)
+
+func TestSendError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{datastore.ErrNotFound, http.StatusNotFound, `{"error":{"code":"not_found","message":"record does not exist"}}`},
+		{datastore.ErrWrongType, http.StatusConflict, `{"error":{"code":"wrong_type","message":"value has a different type"}}`},
+		{datastore.ErrValueTooLarge, http.StatusRequestEntityTooLarge, `{"error":{"code":"too_large","message":"value is too large"}}`},
+		{errUnknownType, http.StatusBadRequest, `{"error":{"code":"unknown_type","message":"unknown data type"}}`},
+		{fmt.Errorf("disk is on fire"), http.StatusInternalServerError, `{"error":{"code":"internal","message":"disk is on fire"}}`},
+	}
+
+	for _, c := range cases {
+		rw := httptest.NewRecorder()
+		sendError(rw, c.err)
+		if rw.Code != c.status {
+			t.Errorf("Unexpected status for %v: %d", c.err, rw.Code)
+		}
+		if body := rw.Body.String(); body != c.body+"\n" {
+			t.Errorf("Unexpected body for %v: %s", c.err, body)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const adminTokenEnv = "LB_ADMIN_TOKEN"
+
+// backendStatus is a backend as listed by the admin API.
+type backendStatus struct {
+	ID           string     `json:"id"`
+	URL          string     `json:"url"`
+	State        string     `json:"state"`
+	Healthy      bool       `json:"healthy"`
+	ConnCnt      int        `json:"connCnt"`
+	Active       int        `json:"active"`
+	Weight       int        `json:"weight"`
+	HealthPath   string     `json:"healthPath"`
+	Tags         []string   `json:"tags,omitempty"`
+	LastCheck    *time.Time `json:"lastCheck,omitempty"`
+	Errors       int        `json:"errors"`
+	LatencyMs    float64    `json:"latencyMs"`
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+	Circuit      string     `json:"circuit"`
+}
+
+func statusOf(s *Server) backendStatus {
+	status := backendStatus{
+		ID:         s.URL,
+		URL:        s.URL,
+		State:      s.state.String(),
+		Healthy:    s.Healthy,
+		ConnCnt:    s.ConnCnt,
+		Active:     s.active,
+		Weight:     s.Weight,
+		HealthPath: s.HealthPath,
+		Tags:       s.Tags,
+		Errors:     s.errors,
+		LatencyMs:  float64(s.latency) / float64(time.Millisecond),
+		Circuit:    breakers.state(s).String(),
+	}
+	if !s.lastCheck.IsZero() {
+		lastCheck := s.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	if outliers.ejected(s) {
+		ejectedUntil := s.ejectedUntil
+		status.EjectedUntil = &ejectedUntil
+	}
+	return status
+}
+
+// adminHandler serves the admin API to requests with the bearer token.
+// Changes made through it last until the backends are reloaded.
+func adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/backends", handleBackends)
+	mux.HandleFunc("/admin/backends/", handleBackend)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="lb-admin"`)
+			sendAdminError(rw, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+		mux.ServeHTTP(rw, r)
+	})
+}
+
+func handleBackends(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		mutex.Lock()
+		list := make([]backendStatus, len(serversPool))
+		for i, s := range serversPool {
+			list[i] = statusOf(s)
+		}
+		mutex.Unlock()
+		sendAdminResponse(rw, http.StatusOK, list)
+	case http.MethodPost:
+		var config BackendConfig
+		decoder := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 64<<10))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			sendAdminError(rw, http.StatusBadRequest, "invalid backend: "+err.Error())
+			return
+		}
+		s, err := addBackend(config)
+		if err != nil {
+			sendAdminError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Backend %s added through the admin API", s.URL)
+		mutex.Lock()
+		status := statusOf(s)
+		mutex.Unlock()
+		sendAdminResponse(rw, http.StatusCreated, status)
+	default:
+		sendAdminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleBackend serves /admin/backends/{id} and /admin/backends/{id}/{action}.
+func handleBackend(rw http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/backends/"), "/")
+
+	var err error
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		mutex.Lock()
+		var status backendStatus
+		s := findBackend(id)
+		if s != nil {
+			status = statusOf(s)
+		}
+		mutex.Unlock()
+		if s == nil {
+			sendAdminError(rw, http.StatusNotFound, "unknown backend "+id)
+			return
+		}
+		sendAdminResponse(rw, http.StatusOK, status)
+		return
+	case action == "" && r.Method == http.MethodDelete:
+		err = removeBackend(id)
+	case r.Method != http.MethodPost:
+		sendAdminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	case action == "drain":
+		err = setBackendState(id, stateDraining)
+	case action == "enable":
+		err = setBackendState(id, stateEnabled)
+	case action == "disable":
+		err = setBackendState(id, stateDisabled)
+	default:
+		sendAdminError(rw, http.StatusNotFound, "unknown action "+action)
+		return
+	}
+	if err != nil {
+		sendAdminError(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	done := map[string]string{"": "removed", "drain": "draining", "enable": "enabled", "disable": "disabled"}
+	log.Printf("Backend %s %s through the admin API", id, done[action])
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// findBackend returns the backend with the id, the caller holds mutex.
+func findBackend(id string) *Server {
+	for _, s := range serversPool {
+		if s.URL == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func addBackend(config BackendConfig) (*Server, error) {
+	mutex.Lock()
+	backends := make([]BackendConfig, 0, len(serversPool)+1)
+	for _, s := range serversPool {
+		backends = append(backends, BackendConfig{URL: s.URL})
+	}
+	backends = append(backends, config)
+	if err := validateBackends(backends); err != nil {
+		mutex.Unlock()
+		return nil, err
+	}
+	s := newServer(config)
+	serversPool = append(serversPool[:len(serversPool):len(serversPool)], s)
+	startHealthChecks(s)
+	mutex.Unlock()
+
+	go checkHealth(s)
+	return s, nil
+}
+
+func removeBackend(id string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for i, s := range serversPool {
+		if s.URL != id {
+			continue
+		}
+		pool := make([]*Server, 0, len(serversPool)-1)
+		pool = append(pool, serversPool[:i]...)
+		serversPool = append(pool, serversPool[i+1:]...)
+		if s.stop != nil {
+			close(s.stop)
+			s.stop = nil
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown backend %s", id)
+}
+
+func setBackendState(id string, state backendState) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	s := findBackend(id)
+	if s == nil {
+		return fmt.Errorf("unknown backend %s", id)
+	}
+	s.state = state
+	return nil
+}
+
+func sendAdminResponse(rw http.ResponseWriter, status int, data interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(data)
+}
+
+func sendAdminError(rw http.ResponseWriter, status int, message string) {
+	sendAdminResponse(rw, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestAdmin_Auth(t *testing.T) {
+	handler := adminHandler("secret")
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/backends", nil)
+		req.Header.Set("Authorization", header)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusUnauthorized, rw.Code, header)
+	}
+}
+
+func TestAdmin_Backends(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(http.StatusOK, ""))
+
+	assert := assert.New(t)
+	handler := adminHandler("secret")
+	serversPool = []*Server{
+		{URL: "server1:8080", ConnCnt: 2, Healthy: true, Weight: 1, HealthPath: "/health", errors: 1},
+		{URL: "server2:8080", Healthy: true, Weight: 1, HealthPath: "/health"},
+	}
+
+	rw := adminRequest(t, handler, http.MethodGet, "/admin/backends", "")
+	assert.Equal(http.StatusOK, rw.Code)
+	var list []backendStatus
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &list))
+	require.Len(t, list, 2)
+	assert.Equal(backendStatus{ID: "server1:8080", URL: "server1:8080", State: "enabled", Healthy: true,
+		ConnCnt: 2, Weight: 1, HealthPath: "/health", Errors: 1, Circuit: "closed"}, list[0])
+
+	rw = adminRequest(t, handler, http.MethodPost, "/admin/backends", `{"url": "server3:8080", "weight": 2}`)
+	assert.Equal(http.StatusCreated, rw.Code)
+	assert.Eventually(func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return serversPool[2].Healthy
+	}, time.Second, 10*time.Millisecond, "added backends are checked right away")
+	rw = adminRequest(t, handler, http.MethodPost, "/admin/backends", `{"url": "server3:8080"}`)
+	assert.Equal(http.StatusBadRequest, rw.Code, "duplicate backend")
+	rw = adminRequest(t, handler, http.MethodPost, "/admin/backends", `{"url": "server4"}`)
+	assert.Equal(http.StatusBadRequest, rw.Code, "invalid backend")
+
+	rw = adminRequest(t, handler, http.MethodPost, "/admin/backends/server1:8080/disable", "")
+	assert.Equal(http.StatusNoContent, rw.Code)
+	rw = adminRequest(t, handler, http.MethodPost, "/admin/backends/server2:8080/drain", "")
+	assert.Equal(http.StatusNoContent, rw.Code)
+	mutex.Lock()
+	assert.Equal(-1, findBestServer(serversPool[:2]), "disabled and draining backends get no requests")
+	mutex.Unlock()
+
+	rw = adminRequest(t, handler, http.MethodPost, "/admin/backends/server1:8080/enable", "")
+	assert.Equal(http.StatusNoContent, rw.Code)
+	rw = adminRequest(t, handler, http.MethodGet, "/admin/backends/server1:8080", "")
+	assert.Contains(rw.Body.String(), `"state":"enabled"`)
+
+	rw = adminRequest(t, handler, http.MethodDelete, "/admin/backends/server2:8080", "")
+	assert.Equal(http.StatusNoContent, rw.Code)
+	rw = adminRequest(t, handler, http.MethodDelete, "/admin/backends/server2:8080", "")
+	assert.Equal(http.StatusNotFound, rw.Code)
+	rw = adminRequest(t, handler, http.MethodPost, "/admin/backends/server1:8080/explode", "")
+	assert.Equal(http.StatusNotFound, rw.Code)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, serversPool, 2)
+	assert.Equal("server1:8080", serversPool[0].URL)
+	assert.Equal("server3:8080", serversPool[1].URL)
+	assert.Equal(2, serversPool[1].Weight)
+	close(serversPool[1].stop)
+	serversPool[1].stop = nil
+}
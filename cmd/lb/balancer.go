@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"sync"
@@ -16,26 +19,109 @@ import (
 )
 
 var (
-	port         = flag.Int("port", 8090, "lb port")
-	timeoutSec   = flag.Int("timeout-sec", 3, "request timeout time in seconds")
-	https        = flag.Bool("https", false, "whether backends support HTTPs")
-	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	port           = flag.Int("port", 8090, "lb port")
+	timeoutSec     = flag.Int("timeout-sec", 3, "request timeout time in seconds")
+	https          = flag.Bool("https", false, "whether backends support HTTPs")
+	traceEnabled   = flag.Bool("trace", false, "whether to include tracing information into responses")
+	backends       = flag.String("backends", "", "comma separated host:port list of backends, each optionally followed by =weight")
+	configPath     = flag.String("config", "", "JSON or YAML file with the backends, reloaded on SIGHUP and when it changes")
+	adminPort      = flag.Int("admin-port", 0, "port of the admin API, 0 disables it")
+	adminToken     = flag.String("admin-token", os.Getenv(adminTokenEnv), "bearer token of the admin API")
+	strategyName   = flag.String("strategy", "least-connections", "balancing strategy: least-connections, round-robin, weighted-round-robin, random, power-of-two, least-response-time or consistent-hash")
+	hashBy         = flag.String("hash-key", "query:key", "request attribute of consistent-hash: query:<param>, header:<name>, path:<segment> or ip")
+	stickyCookie   = flag.String("sticky-cookie", "", "cookie pinning clients to a backend, sticky sessions are off without it and -sticky-header")
+	stickyHeader   = flag.String("sticky-header", "", "header pinning clients to a backend, set on the responses and honored on the requests")
+	stickyTTL      = flag.Duration("sticky-ttl", time.Hour, "how long a client stays pinned to a backend")
+	stickySecret   = flag.String("sticky-secret", os.Getenv(stickySecretEnv), "key signing the sticky session tokens")
+	maxRetries     = flag.Int("retries", 2, "how many other backends a failed request is retried on")
+	retryRatio     = flag.Float64("retry-budget", 0.2, "retries allowed per request on average, so failures don't cause retry storms")
+	retryBodyLimit = flag.Int64("retry-body-limit", 64<<10, "request bodies up to this size are buffered so the request can be retried")
+	outlierFails   = flag.Int("outlier-failures", 5, "failed requests in a row ejecting a backend, 0 disables ejection")
+	outlierBase    = flag.Duration("outlier-base-ejection", 30*time.Second, "how long a backend is ejected the first time, doubled every next time")
+	outlierMax     = flag.Duration("outlier-max-ejection", 5*time.Minute, "the longest ejection")
+	outlierPercent = flag.Int("outlier-max-percent", 50, "the most backends ejected at once, in percent of the pool")
+	healthInterval = flag.Duration("health-interval", healthCheckInterval, "default interval of the health checks")
+	healthTimeout  = flag.Duration("health-timeout", 0, "default timeout of the health checks, -timeout-sec if 0")
+	breakerWindow  = flag.Duration("breaker-window", 10*time.Second, "sliding window of the circuit breakers")
+	breakerMinReqs = flag.Int("breaker-min-requests", 20, "requests in the window needed to open a circuit, 0 disables the circuit breakers")
+	breakerErrors  = flag.Float64("breaker-error-rate", 0.5, "share of failed requests in the window opening a circuit")
+	breakerSlow    = flag.Duration("breaker-slow-call", time.Second, "requests slower than this count as slow, 0 disables it")
+	breakerSlowMax = flag.Float64("breaker-slow-rate", 0.5, "share of slow requests in the window opening a circuit")
+	breakerOpen    = flag.Duration("breaker-open-time", 10*time.Second, "how long an open circuit gets no requests before it is probed")
+	breakerProbes  = flag.Int("breaker-probes", 3, "requests let through a half-open circuit, all of them have to succeed to close it")
+	hedge          = flag.Bool("hedge", false, "whether GET requests are hedged: sent to a second backend when the first is slow")
+	hedgePct       = flag.Float64("hedge-percentile", 95, "latency percentile after which a request is hedged")
+	hedgeMinDelay  = flag.Duration("hedge-min-delay", 10*time.Millisecond, "the shortest wait before a request is hedged")
+	hedgeRate      = flag.Float64("hedge-max-rate", 0.05, "hedged requests allowed per request on average")
+	rateLimitRate  = flag.Float64("rate-limit", 0, "requests a second allowed to a client, 0 disables rate limiting")
+	rateLimitBurst = flag.Int("rate-limit-burst", 0, "requests a client can send at once, -rate-limit rounded up if 0")
+	rateLimitKey   = flag.String("rate-limit-key", "ip", "what identifies a client: ip, header:<name>, query:<param> or path:<segment>")
+	maxInFlight    = flag.Int("max-in-flight", 0, "requests in flight to all backends, 0 is unlimited")
+	backendMax     = flag.Int("backend-max-in-flight", 0, "requests in flight to a backend, 0 is unlimited")
+	queueTimeout   = flag.Duration("queue-timeout", 100*time.Millisecond, "how long a request over an in-flight limit waits for a slot")
+	selfHealthPath = flag.String("lb-health-path", "/lb/health", "path of the health check of the balancer itself, failing while it shuts down")
+	drainDelay     = flag.Duration("drain-delay", 5*time.Second, "how long the balancer fails its health check before it stops accepting requests")
+	shutdownWait   = flag.Duration("shutdown-timeout", 10*time.Second, "how long the requests in flight are waited for on shutdown")
+	tlsCert        = flag.String("tls-cert", "", "comma separated certificate files the balancer serves HTTPS with, picked by the SNI name of the clients")
+	tlsKey         = flag.String("tls-key", "", "comma separated key files of -tls-cert, in the same order")
+	tlsClientCA    = flag.String("tls-client-ca", "", "CA file the client certificates have to be signed by, mutual TLS is off without it")
+	backendCA      = flag.String("backend-ca", "", "CA file the backend certificates are verified with when -https is set, the system CAs if empty")
+	backendCert    = flag.String("backend-cert", "", "certificate file the balancer presents to HTTPS backends")
+	backendKey     = flag.String("backend-key", "", "key file of -backend-cert")
+	configCheck    = flag.Duration("config-check-interval", 5*time.Second, "how often the config file is checked for changes, 0 disables it")
 )
 
 type Server struct {
-	URL     string
-	ConnCnt int
-	Healthy bool
+	URL        string
+	ConnCnt    int
+	Healthy    bool
+	Weight     int
+	HealthPath string
+	Tags       []string
+
+	active    int           // requests in flight
+	stop      chan struct{} // stops the health checks
+	state     backendState
+	lastCheck time.Time
+	errors    int           // failed forwards: connection errors and 5xx answers
+	latency   time.Duration // moving average of the time to the response headers
+
+	failures     int // failed forwards in a row
+	ejections    int // ejections in a row, each one lasts twice as long
+	ejectedUntil time.Time
+
+	check          healthCheck
+	probed         bool // whether the backend was health checked
+	probeSuccesses int  // health checks passed in a row
+	probeFailures  int  // health checks failed in a row
+
+	breaker circuitBreaker
 }
 
-var (
-	timeout     = time.Duration(*timeoutSec) * time.Second
-	serversPool = []*Server{
-		{URL: "server1:8080"},
-		{URL: "server2:8080"},
-		{URL: "server3:8080"},
+// backendState is set through the admin API, only enabled backends get new requests.
+type backendState int
+
+const (
+	stateEnabled backendState = iota
+	stateDraining
+	stateDisabled
+)
+
+func (s backendState) String() string {
+	switch s {
+	case stateDraining:
+		return "draining"
+	case stateDisabled:
+		return "disabled"
 	}
-	mutex sync.Mutex
+	return "enabled"
+}
+
+var (
+	timeout     = 3 * time.Second
+	serversPool []*Server
+	strategy    Strategy = leastConnections{}
+	mutex       sync.Mutex
 )
 
 func scheme() string {
@@ -45,29 +131,20 @@ func scheme() string {
 	return "http"
 }
 
-func health(server *Server) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), server.URL), nil)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false
-	}
-	if resp.StatusCode != http.StatusOK {
-		return false
-	}
-	server.Healthy = true
-	return true
-}
-
-func findBestServer(pool []*Server) int {
+// findBestServer returns the available backend with the fewest requests in
+// flight, of those tied the one that got the fewest requests. The backends
+// in tried are skipped.
+func findBestServer(pool []*Server, tried ...*Server) int {
 	bestServerIndex := -1
+	bestServerActive := -1
 	bestServerConnCnt := -1
 
 	for i, server := range pool {
-		if server.Healthy {
-			if bestServerIndex == -1 || server.ConnCnt < bestServerConnCnt {
+		if usable(server, tried) {
+			if bestServerIndex == -1 || server.active < bestServerActive ||
+				server.active == bestServerActive && server.ConnCnt < bestServerConnCnt {
 				bestServerIndex = i
+				bestServerActive = server.active
 				bestServerConnCnt = server.ConnCnt
 			}
 		}
@@ -77,73 +154,273 @@ func findBestServer(pool []*Server) int {
 }
 
 func forward(rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-
-	mutex.Lock()
-	minServerIndex := findBestServer(serversPool)
+	replayable, err := bufferBody(r, *retryBodyLimit)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+	retryTokens.deposit()
 
-	if minServerIndex == -1 {
+	var tried []*Server
+	for retries := 0; ; retries++ {
+		mutex.Lock()
+		dst, repin := pickBackend(serversPool, r, tried...)
+		if dst == nil && len(tried) == 0 {
+			dst, repin = waitForBackend(r)
+		}
+		if dst == nil {
+			if saturated(serversPool) {
+				setRetryAfter(rw, time.Second)
+			}
+			mutex.Unlock()
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("all servers are busy")
+		}
+		dst.ConnCnt++
+		dst.active++
+		breakers.acquire(dst)
 		mutex.Unlock()
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		return fmt.Errorf("all servers are busy")
+
+		var used []*Server
+		used, err = forwardTo(rw, r, dst, repin, tried)
+		tried = append(tried, used...)
+		if err == nil {
+			return nil
+		}
+		if retries >= *maxRetries || !replayable || !canRetry(r, err) || !retryTokens.withdraw() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return err
+		}
+		retriesTotal.Inc()
+		log.Printf("Retrying %s %s on another backend", r.Method, r.URL)
 	}
+}
 
-	dst := serversPool[minServerIndex]
-	dst.ConnCnt++
-	mutex.Unlock()
+// forwardTo sends the request to the backend, hedged if it is enabled, and
+// copies the response. It returns the backends the request was sent to and
+// the error of a request that failed before anything was written.
+func forwardTo(rw http.ResponseWriter, r *http.Request, dst *Server, repin bool, tried []*Server) ([]*Server, error) {
+	var a *attempt
+	used := []*Server{dst}
+	if hedging != nil && hedgeable(r) {
+		a, used = hedged(r, dst, repin, tried)
+	} else {
+		a = newAttempt(r, dst, repin)
+		a.run()
+	}
+	defer a.finish()
+	if a.err != nil {
+		return used, a.err
+	}
+
+	proxyResponseHeaders(rw.Header(), a.resp)
+	if a.repin {
+		sessions.pin(rw, r, a.dst.URL)
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-from", a.dst.URL)
+	}
+	rw.WriteHeader(a.resp.StatusCode)
+	if _, err := io.Copy(rw, a.resp.Body); err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return used, nil
+	}
+	copyTrailers(rw.Header(), a.resp)
+	return used, nil
+}
+
+// attempt is the request sent to one backend.
+type attempt struct {
+	req    *http.Request
+	dst    *Server
+	repin  bool
+	cancel context.CancelFunc
+
+	resp     *http.Response
+	err      error
+	recorded bool // the result counts for the backend
+}
+
+// newAttempt prepares the request for the backend, which already counts it
+// in ConnCnt and active.
+func newAttempt(r *http.Request, dst *Server, repin bool) *attempt {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	fwdRequest := r.Clone(ctx)
+	if r.GetBody != nil {
+		fwdRequest.Body, _ = r.GetBody()
+	}
 
 	fwdRequest.RequestURI = ""
 	fwdRequest.URL.Host = dst.URL
 	fwdRequest.URL.Scheme = scheme()
 	fwdRequest.Host = dst.URL
+	fwdRequest.Close = false
+	proxyRequestHeaders(fwdRequest, r)
+	if len(r.Trailer) > 0 {
+		// streamed bodies get their trailers at the end, and only chunked
+		// requests carry them
+		fwdRequest.Trailer = r.Trailer
+		fwdRequest.ContentLength = -1
+	}
+	return &attempt{req: fwdRequest, dst: dst, repin: repin, cancel: cancel}
+}
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
-			}
-		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst.URL)
-		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
-		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+// run sends the request and records its result, unless the attempt was
+// cancelled because another one answered first.
+func (a *attempt) run() {
+	start := time.Now()
+	a.resp, a.err = backendClient.Do(a.req)
+	latency := time.Since(start)
+	if a.err != nil {
+		if errors.Is(a.req.Context().Err(), context.Canceled) {
+			return
 		}
-		return nil
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst.URL, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		return err
+		log.Printf("Failed to get response from %s: %s", a.dst.URL, a.err)
+		forwardedTotal.With(a.dst.URL, "error").Inc()
+		recordResult(a.dst, true, latency)
+		a.recorded = true
+		return
 	}
+
+	mutex.Lock()
+	a.dst.observeLatency(latency)
+	mutex.Unlock()
+	if hedging != nil {
+		hedging.observe(latency)
+	}
+	log.Println("fwd", a.resp.StatusCode, a.req.URL)
+	forwardedTotal.With(a.dst.URL, strconv.Itoa(a.resp.StatusCode)).Inc()
+	recordResult(a.dst, a.resp.StatusCode >= 500, latency)
+	a.recorded = true
+}
+
+// finish releases the response and the backend, and the probe slot of the
+// backend if the attempt had no result.
+func (a *attempt) finish() {
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+	a.cancel()
+	mutex.Lock()
+	a.dst.active--
+	if !a.recorded {
+		breakers.release(a.dst)
+	}
+	mutex.Unlock()
+	slotFreed.Broadcast()
+}
+
+// recordResult counts a request forwarded to the backend, failed requests
+// got no answer or a 5xx one.
+func recordResult(s *Server, failed bool, latency time.Duration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if failed {
+		s.errors++
+	}
+	outliers.record(s, failed)
+	breakers.record(s, failed, latency)
 }
 
 func main() {
 	flag.Parse()
+	timeout = time.Duration(*timeoutSec) * time.Second
+	var err error
+	strategy, err = newStrategy(*strategyName, *hashBy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	retryTokens = newRetryBudget(*retryRatio)
+	outliers = &outlierDetection{
+		failures:   *outlierFails,
+		baseTime:   *outlierBase,
+		maxTime:    *outlierMax,
+		maxPercent: *outlierPercent,
+		now:        time.Now,
+	}
+	breakers = &breakerConfig{
+		window:      *breakerWindow,
+		minRequests: *breakerMinReqs,
+		errorRate:   *breakerErrors,
+		slowCall:    *breakerSlow,
+		slowRate:    *breakerSlowMax,
+		openTime:    *breakerOpen,
+		probes:      *breakerProbes,
+		now:         time.Now,
+	}
+	if *hedge {
+		hedging = newHedger(*hedgePct, *hedgeMinDelay)
+		hedgeTokens = newRetryBudget(*hedgeRate)
+	}
+	rateLimit, err = newRateLimiter(*rateLimitRate, *rateLimitBurst, *rateLimitKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	inFlight = newInFlightLimits(*maxInFlight, *backendMax, *queueTimeout)
+	serverTLS, err := frontendTLS(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		log.Fatalf("Invalid TLS config: %s", err)
+	}
+	var tlsOpts []httptools.Option
+	if serverTLS != nil {
+		tlsOpts = append(tlsOpts, httptools.WithTLS(serverTLS))
+	}
+	if *https {
+		backendClient, err = newBackendClient(*backendCA, *backendCert, *backendKey)
+		if err != nil {
+			log.Fatalf("Invalid backend TLS config: %s", err)
+		}
+	}
+	sessions, err = newAffinity(*stickyCookie, *stickyHeader, *stickyTTL, *stickySecret)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	pool, err := buildPool(*backends, *configPath)
+	if err != nil {
+		log.Fatalf("Invalid backends: %s", err)
+	}
+	serversPool = pool
 	for _, server := range serversPool {
-		server.Healthy = health(server)
-		go func(s *Server) {
-			for range time.Tick(10 * time.Second) {
-				mutex.Lock()
-				s.Healthy = health(s)
-				log.Printf("%s: health=%t, connCnt=%d", s.URL, s.Healthy, s.ConnCnt)
-				mutex.Unlock()
-			}
-		}(server)
+		log.Printf("Backend %s: weight=%d, health=%s, tags=%v", server.URL, server.Weight, server.HealthPath, server.Tags)
+	}
+	registerMetrics()
+
+	for _, server := range serversPool {
+		checkHealth(server)
+		startHealthChecks(server)
+	}
+	signal.OnReload(reloadPool)
+	var servers []httptools.Server
+	if *adminPort > 0 {
+		if *adminToken == "" {
+			log.Fatal("The admin API needs a token, set -admin-token or " + adminTokenEnv)
+		}
+		admin := httptools.CreateServer(*adminPort, adminHandler(*adminToken), tlsOpts...)
+		admin.Start()
+		servers = append(servers, admin)
+	}
+	if *configPath != "" && *configCheck > 0 {
+		go watchConfig(*configPath, *configCheck)
 	}
 
 	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		forward(rw, r)
-	}))
+		if r.URL.Path == *selfHealthPath {
+			serveHealth(rw)
+			return
+		}
+		limit(rw, r)
+	}), tlsOpts...)
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("Balancing strategy: %s", *strategyName)
+	log.Printf("Sticky sessions enabled: %t", sessions != nil)
+	log.Printf("TLS termination enabled: %t", serverTLS != nil)
 	frontend.Start()
 	signal.WaitForTerminationSignal()
+	shutdown(*drainDelay, *shutdownWait, append([]httptools.Server{frontend}, servers...)...)
 }
\ No newline at end of file
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
@@ -74,17 +75,13 @@ func TestHealth(t *testing.T) {
 		URL: "example.com",
 	}
 
-	result := health(server)
+	checkHealth(server)
 
-	assert.True(t, result)
 	assert.True(t, server.Healthy)
 
-	server.Healthy = false // скинув перед некст тестом
-
 	httpmock.RegisterResponder(http.MethodGet, mockURL, httpmock.NewStringResponder(http.StatusInternalServerError, ""))
-	result2 := health(server)
+	checkHealth(server)
 
-	assert.False(t, result2)
 	assert.False(t, server.Healthy)
 }
 
@@ -125,3 +122,153 @@ func TestForwardWithUnhealthyServer(t *testing.T) {
 	err = forward(rr, req)
 	assert.NotNil(err)
 }
+
+func pickN(s Strategy, pool []*Server, n int) []int {
+	picks := make([]int, n)
+	for i := range picks {
+		picks[i] = s.Pick(pool, nil)
+	}
+	return picks
+}
+
+func TestNewStrategy(t *testing.T) {
+	for name := range strategies {
+		s, err := newStrategy(name, "")
+		assert.NoError(t, err, name)
+		assert.NotNil(t, s, name)
+	}
+	s, err := newStrategy("consistent-hash", "header:X-User")
+	assert.NoError(t, err)
+	assert.IsType(t, &consistentHash{}, s)
+	_, err = newStrategy("consistent-hash", "cookie:user")
+	assert.Error(t, err)
+	_, err = newStrategy("fastest", "")
+	assert.Error(t, err)
+}
+
+func TestStrategies_NoAvailableServers(t *testing.T) {
+	pool := []*Server{
+		{URL: "Server1", Healthy: false},
+		{URL: "Server2", Healthy: true, state: stateDraining},
+		{URL: "Server3", Healthy: true, state: stateDisabled},
+	}
+	for name := range strategies {
+		s, _ := newStrategy(name, "")
+		assert.Equal(t, -1, s.Pick(pool, nil), name)
+		assert.Equal(t, -1, s.Pick(nil, nil), name)
+	}
+}
+
+func TestStrategies_Tried(t *testing.T) {
+	pool := []*Server{
+		{URL: "Server1", Healthy: true},
+		{URL: "Server2", Healthy: true},
+		{URL: "Server3", Healthy: true},
+	}
+	for name := range strategies {
+		s, _ := newStrategy(name, "")
+		i := s.Pick(pool, nil)
+		j := s.Pick(pool, nil, pool[i])
+		assert.NotEqual(t, -1, j, name)
+		assert.NotEqual(t, i, j, name)
+		assert.Equal(t, -1, s.Pick(pool, nil, pool...), name)
+	}
+
+	t.Run("Retries keep the rotation", func(t *testing.T) {
+		s := &roundRobin{}
+		assert.Equal(t, 0, s.Pick(pool, nil))
+		assert.Equal(t, 1, s.Pick(pool, nil, pool[0]))
+		assert.Equal(t, []int{2, 0, 1}, pickN(s, pool, 3))
+	})
+}
+
+func TestLeastConnections(t *testing.T) {
+	pool := []*Server{
+		{URL: "Server1", ConnCnt: 10, Healthy: true},
+		{URL: "Server2", ConnCnt: 5, Healthy: true, state: stateDraining},
+		{URL: "Server3", ConnCnt: 7, Healthy: true},
+	}
+	assert.Equal(t, 2, leastConnections{}.Pick(pool, nil))
+
+	t.Run("Requests in flight", func(t *testing.T) {
+		pool := []*Server{
+			{URL: "Server1", ConnCnt: 1000, Healthy: true, active: 1},
+			{URL: "Server2", ConnCnt: 0, Healthy: true, active: 3},
+			{URL: "Server3", ConnCnt: 500, Healthy: true, active: 1},
+		}
+		assert.Equal(t, 2, leastConnections{}.Pick(pool, nil), "the requests since startup only break ties")
+	})
+}
+
+func TestRoundRobin(t *testing.T) {
+	pool := []*Server{
+		{URL: "Server1", Healthy: true},
+		{URL: "Server2", Healthy: false},
+		{URL: "Server3", Healthy: true},
+		{URL: "Server4", Healthy: true},
+	}
+	assert.Equal(t, []int{0, 2, 3, 0, 2, 3}, pickN(&roundRobin{}, pool, 6))
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	pool := []*Server{
+		{URL: "Server1", Healthy: true, Weight: 5},
+		{URL: "Server2", Healthy: true, Weight: 1},
+		{URL: "Server3", Healthy: true, Weight: 1},
+	}
+	// The smooth sequence of nginx for weights 5, 1, 1.
+	assert.Equal(t, []int{0, 0, 1, 0, 2, 0, 0}, pickN(&weightedRoundRobin{}, pool, 7))
+
+	pool[0].Healthy = false
+	picks := pickN(&weightedRoundRobin{}, pool, 4)
+	assert.ElementsMatch(t, []int{1, 1, 2, 2}, picks)
+}
+
+func TestRandom(t *testing.T) {
+	pool := []*Server{
+		{URL: "Server1", Healthy: true},
+		{URL: "Server2", Healthy: false},
+		{URL: "Server3", Healthy: true},
+	}
+	counts := make(map[int]int)
+	for _, i := range pickN(&random{newRand()}, pool, 1000) {
+		counts[i]++
+	}
+	assert.Zero(t, counts[1])
+	assert.Greater(t, counts[0], 300)
+	assert.Greater(t, counts[2], 300)
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	pool := []*Server{
+		{URL: "Server1", Healthy: true, active: 10},
+		{URL: "Server2", Healthy: true, active: 0},
+	}
+	// With two backends both are always compared.
+	assert.Equal(t, []int{1, 1, 1, 1}, pickN(&powerOfTwo{newRand()}, pool, 4))
+
+	pool = append(pool, &Server{URL: "Server3", Healthy: true, active: 5})
+	for _, i := range pickN(&powerOfTwo{newRand()}, pool, 100) {
+		assert.NotEqual(t, 0, i, "the busiest backend never wins a comparison")
+	}
+}
+
+func TestLeastResponseTime(t *testing.T) {
+	pool := []*Server{
+		{URL: "Server1", Healthy: true, latency: 30 * time.Millisecond},
+		{URL: "Server2", Healthy: true, latency: 10 * time.Millisecond},
+		{URL: "Server3", Healthy: true, latency: 20 * time.Millisecond},
+	}
+	assert.Equal(t, 1, leastResponseTime{}.Pick(pool, nil))
+
+	pool = append(pool, &Server{URL: "Server4", Healthy: true})
+	assert.Equal(t, 3, leastResponseTime{}.Pick(pool, nil), "unmeasured backends go first")
+}
+
+func TestObserveLatency(t *testing.T) {
+	s := &Server{}
+	s.observeLatency(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, s.latency)
+	s.observeLatency(200 * time.Millisecond)
+	assert.Equal(t, 130*time.Millisecond, s.latency)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// windowBuckets is the number of buckets the sliding window is split into.
+const windowBuckets = 10
+
+// breakerConfig opens the circuit of a backend when errorRate of the
+// requests in the window fail or slowRate of them take longer than slowCall.
+// An open circuit gets no requests for openTime, then probes requests are let
+// through and the circuit closes if they all succeed.
+type breakerConfig struct {
+	window      time.Duration
+	minRequests int // requests in the window needed to open, 0 disables the breaker
+	errorRate   float64
+	slowCall    time.Duration // 0 doesn't count slow requests
+	slowRate    float64
+	openTime    time.Duration
+	probes      int
+	now         func() time.Time
+}
+
+var breakers = &breakerConfig{
+	window:      10 * time.Second,
+	minRequests: 20,
+	errorRate:   0.5,
+	slowCall:    time.Second,
+	slowRate:    0.5,
+	openTime:    10 * time.Second,
+	probes:      3,
+	now:         time.Now,
+}
+
+// circuitBreaker is the state of the breaker of a backend, kept under mutex.
+type circuitBreaker struct {
+	state    circuitState
+	buckets  [windowBuckets]breakerBucket
+	openedAt time.Time
+	probing  int // half-open requests in flight
+	passed   int // half-open requests succeeded
+}
+
+type breakerBucket struct {
+	start                    time.Time
+	requests, failures, slow int
+}
+
+// state returns the state of the circuit, an open one turns half-open once
+// openTime passes.
+func (c *breakerConfig) state(s *Server) circuitState {
+	b := &s.breaker
+	if b.state == circuitOpen && !c.now().Before(b.openedAt.Add(c.openTime)) {
+		return circuitHalfOpen
+	}
+	return b.state
+}
+
+// admits reports whether the backend can get a request, it doesn't change
+// the breaker.
+func (c *breakerConfig) admits(s *Server) bool {
+	switch c.state(s) {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		return s.breaker.probing < c.probes
+	}
+	return true
+}
+
+// acquire is called for the requests sent to the backend.
+func (c *breakerConfig) acquire(s *Server) {
+	b := &s.breaker
+	if c.state(s) == circuitHalfOpen {
+		if b.state == circuitOpen {
+			b.state, b.probing, b.passed = circuitHalfOpen, 0, 0
+			log.Printf("Circuit of %s is half-open", s.URL)
+		}
+		b.probing++
+	}
+}
+
+// release frees the probe slot of a request that ended without a result,
+// like a cancelled one.
+func (c *breakerConfig) release(s *Server) {
+	if b := &s.breaker; b.state == circuitHalfOpen && b.probing > 0 {
+		b.probing--
+	}
+}
+
+// record counts the result of a request of the backend and opens or closes
+// its circuit.
+func (c *breakerConfig) record(s *Server, failed bool, latency time.Duration) {
+	if c.minRequests <= 0 {
+		return
+	}
+	b := &s.breaker
+	slow := c.slowCall > 0 && latency >= c.slowCall
+	switch b.state {
+	case circuitOpen:
+		// answers of requests sent before the circuit opened
+	case circuitHalfOpen:
+		if b.probing > 0 {
+			b.probing--
+		}
+		if failed || slow {
+			c.open(s, "a probe failed")
+			return
+		}
+		b.passed++
+		if b.passed >= c.probes {
+			*b = circuitBreaker{}
+			log.Printf("Circuit of %s is closed", s.URL)
+		}
+	case circuitClosed:
+		bucket := c.bucket(b)
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+		if slow {
+			bucket.slow++
+		}
+		requests, failures, slowCount := c.totals(b)
+		if requests < c.minRequests {
+			return
+		}
+		if float64(failures) >= c.errorRate*float64(requests) {
+			c.open(s, "too many errors")
+		} else if c.slowCall > 0 && float64(slowCount) >= c.slowRate*float64(requests) {
+			c.open(s, "too many slow requests")
+		}
+	}
+}
+
+func (c *breakerConfig) open(s *Server, reason string) {
+	s.breaker = circuitBreaker{state: circuitOpen, openedAt: c.now()}
+	circuitOpensTotal.With(s.URL).Inc()
+	log.Printf("Circuit of %s is open for %s: %s", s.URL, c.openTime, reason)
+}
+
+func (c *breakerConfig) bucketSize() time.Duration {
+	size := c.window / windowBuckets
+	if size <= 0 {
+		size = 1
+	}
+	return size
+}
+
+// bucket returns the bucket of the current time, emptied if it is stale.
+func (c *breakerConfig) bucket(b *circuitBreaker) *breakerBucket {
+	now := c.now()
+	size := c.bucketSize()
+	start := now.Truncate(size)
+	bucket := &b.buckets[(start.UnixNano()/int64(size))%windowBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// totals sums the buckets inside the window.
+func (c *breakerConfig) totals(b *circuitBreaker) (requests, failures, slow int) {
+	oldest := c.now().Add(-c.window)
+	for _, bucket := range b.buckets {
+		if bucket.start.After(oldest) {
+			requests += bucket.requests
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+	return requests, failures, slow
+}
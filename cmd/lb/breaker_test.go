@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func withBreakers(t *testing.T) *time.Time {
+	now := time.Unix(1700000000, 0)
+	saved := breakers
+	breakers = &breakerConfig{
+		window:      10 * time.Second,
+		minRequests: 4,
+		errorRate:   0.5,
+		slowCall:    time.Second,
+		slowRate:    0.75,
+		openTime:    5 * time.Second,
+		probes:      2,
+		now:         func() time.Time { return now },
+	}
+	t.Cleanup(func() { breakers = saved })
+	return &now
+}
+
+// send records a request through the breaker of the backend.
+func send(s *Server, failed bool, latency time.Duration) {
+	breakers.acquire(s)
+	breakers.record(s, failed, latency)
+}
+
+func TestCircuitBreaker_Errors(t *testing.T) {
+	now := withBreakers(t)
+	s := &Server{URL: "server1:8080", Healthy: true}
+
+	send(s, true, 0)
+	send(s, true, 0)
+	send(s, true, 0)
+	assert.Equal(t, circuitClosed, breakers.state(s), "too few requests to judge")
+	send(s, false, 0)
+	assert.Equal(t, circuitOpen, breakers.state(s))
+	assert.False(t, available(s))
+	assert.Equal(t, -1, findBestServer([]*Server{s}))
+
+	*now = now.Add(5 * time.Second)
+	assert.Equal(t, circuitHalfOpen, breakers.state(s))
+	assert.True(t, available(s))
+
+	t.Run("Half-open admits the probes", func(t *testing.T) {
+		breakers.acquire(s)
+		breakers.acquire(s)
+		assert.False(t, available(s))
+		breakers.record(s, false, 0)
+		assert.True(t, available(s))
+		breakers.record(s, true, 0)
+		assert.Equal(t, circuitOpen, breakers.state(s), "a failed probe opens it again")
+	})
+
+	t.Run("Successful probes close it", func(t *testing.T) {
+		*now = now.Add(5 * time.Second)
+		send(s, false, 0)
+		assert.Equal(t, circuitHalfOpen, breakers.state(s))
+		send(s, false, 0)
+		assert.Equal(t, circuitClosed, breakers.state(s))
+	})
+}
+
+// halfOpen opens the circuit of the backend and waits for it to turn
+// half-open.
+func halfOpen(s *Server, now *time.Time) {
+	for i := 0; i < breakers.minRequests; i++ {
+		send(s, true, 0)
+	}
+	*now = now.Add(breakers.openTime)
+}
+
+func TestCircuitBreaker_Release(t *testing.T) {
+	now := withBreakers(t)
+	s := &Server{URL: "server1:8080", Healthy: true}
+	halfOpen(s, now)
+
+	breakers.acquire(s)
+	breakers.acquire(s)
+	assert.False(t, available(s))
+	breakers.release(s)
+	assert.True(t, available(s), "the probe slot is free again")
+	breakers.release(s)
+	breakers.release(s)
+	assert.Zero(t, s.breaker.probing)
+}
+
+func TestForward_CancelledProbe(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "http://server1:8080/", func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+
+	now := withBreakers(t)
+	s := &Server{URL: "server1:8080", Healthy: true}
+	serversPool = []*Server{s}
+	halfOpen(s, now)
+
+	for i := 0; i < breakers.probes+1; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel) // the client disconnects
+		forward(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, circuitHalfOpen, breakers.state(s))
+	assert.Zero(t, s.breaker.probing, "the client went away, the probes don't count")
+	assert.True(t, available(s))
+}
+
+func TestCircuitBreaker_Slow(t *testing.T) {
+	withBreakers(t)
+	s := &Server{URL: "server1:8080", Healthy: true}
+
+	send(s, false, 2*time.Second)
+	send(s, false, 2*time.Second)
+	send(s, false, 2*time.Second)
+	send(s, false, 10*time.Millisecond)
+	assert.Equal(t, circuitOpen, breakers.state(s))
+}
+
+func TestCircuitBreaker_Window(t *testing.T) {
+	now := withBreakers(t)
+	s := &Server{URL: "server1:8080", Healthy: true}
+
+	send(s, true, 0)
+	send(s, true, 0)
+	send(s, true, 0)
+	*now = now.Add(11 * time.Second)
+	send(s, false, 0)
+	send(s, true, 0)
+	send(s, false, 0)
+	assert.Equal(t, circuitClosed, breakers.state(s), "old failures leave the window")
+	send(s, false, 0)
+	send(s, true, 0)
+	assert.Equal(t, circuitClosed, breakers.state(s), "2 of 5 failed")
+	send(s, true, 0)
+	assert.Equal(t, circuitOpen, breakers.state(s))
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	withBreakers(t)
+	breakers.minRequests = 0
+	s := &Server{URL: "server1:8080", Healthy: true}
+	for i := 0; i < 10; i++ {
+		send(s, true, 0)
+	}
+	assert.Equal(t, circuitClosed, breakers.state(s))
+}
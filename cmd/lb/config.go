@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultHealthPath = "/health"
+
+// defaultBackends are used when neither -backends nor -config is given.
+var defaultBackends = []string{"server1:8080", "server2:8080", "server3:8080"}
+
+// BackendConfig describes a backend of the pool.
+type BackendConfig struct {
+	URL        string   `json:"url" yaml:"url"`
+	Weight     int      `json:"weight,omitempty" yaml:"weight,omitempty"`
+	HealthPath string   `json:"healthPath,omitempty" yaml:"healthPath,omitempty"`
+	Tags       []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+
+	HealthCheck *HealthCheckConfig `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+}
+
+// HealthCheckConfig tunes the health checks of a backend, unset fields
+// keep the defaults of the flags.
+type HealthCheckConfig struct {
+	Interval           Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Status             []int    `json:"status,omitempty" yaml:"status,omitempty"`
+	Body               string   `json:"body,omitempty" yaml:"body,omitempty"`
+	HealthyThreshold   int      `json:"healthyThreshold,omitempty" yaml:"healthyThreshold,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthyThreshold,omitempty" yaml:"unhealthyThreshold,omitempty"`
+}
+
+const (
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 2
+)
+
+// Duration is a time.Duration written as a string like "1m30s" in the
+// config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\"")
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.parse(node.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config is the configuration file of the balancer in JSON or YAML.
+type Config struct {
+	Backends []BackendConfig `json:"backends" yaml:"backends"`
+}
+
+// loadConfig reads the config file, the format is chosen by its extension.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format, expected .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// parseBackends parses a comma separated list of host:port pairs, each
+// optionally followed by =weight.
+func parseBackends(list string) ([]BackendConfig, error) {
+	var backends []BackendConfig
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		backend := BackendConfig{URL: item}
+		if url, weight, ok := strings.Cut(item, "="); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil {
+				return nil, fmt.Errorf("backend %s: invalid weight %q", url, weight)
+			}
+			backend = BackendConfig{URL: url, Weight: w}
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// buildPool combines the backends of the flag and the config file and
+// validates them, filling in the defaults.
+func buildPool(backendsFlag, configPath string) ([]*Server, error) {
+	backends, err := parseBackends(backendsFlag)
+	if err != nil {
+		return nil, err
+	}
+	if configPath != "" {
+		config, err := loadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, config.Backends...)
+	}
+	if backendsFlag == "" && configPath == "" {
+		for _, url := range defaultBackends {
+			backends = append(backends, BackendConfig{URL: url})
+		}
+	}
+
+	if err := validateBackends(backends); err != nil {
+		return nil, err
+	}
+	pool := make([]*Server, len(backends))
+	for i, b := range backends {
+		pool[i] = newServer(b)
+	}
+	return pool, nil
+}
+
+func validateBackends(backends []BackendConfig) error {
+	if len(backends) == 0 {
+		return fmt.Errorf("no backends configured")
+	}
+	seen := make(map[string]bool, len(backends))
+	for _, b := range backends {
+		host, port, err := net.SplitHostPort(b.URL)
+		if err != nil || host == "" {
+			return fmt.Errorf("backend %q: expected host:port", b.URL)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("backend %s: invalid port %q", b.URL, port)
+		}
+		if seen[b.URL] {
+			return fmt.Errorf("backend %s is configured twice", b.URL)
+		}
+		seen[b.URL] = true
+		if b.Weight < 0 {
+			return fmt.Errorf("backend %s: weight can't be negative", b.URL)
+		}
+		if b.HealthPath != "" && !strings.HasPrefix(b.HealthPath, "/") {
+			return fmt.Errorf("backend %s: health path must start with /", b.URL)
+		}
+		if err := validateHealthCheck(b.HealthCheck); err != nil {
+			return fmt.Errorf("backend %s: %w", b.URL, err)
+		}
+	}
+	return nil
+}
+
+func validateHealthCheck(c *HealthCheckConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("health check interval and timeout can't be negative")
+	}
+	if c.HealthyThreshold < 0 || c.UnhealthyThreshold < 0 {
+		return fmt.Errorf("health check thresholds can't be negative")
+	}
+	for _, code := range c.Status {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid health check status %d", code)
+		}
+	}
+	return nil
+}
+
+// newHealthCheck fills in the defaults of the health check.
+func newHealthCheck(c *HealthCheckConfig) healthCheck {
+	check := healthCheck{
+		interval:           *healthInterval,
+		timeout:            *healthTimeout,
+		healthyThreshold:   defaultHealthyThreshold,
+		unhealthyThreshold: defaultUnhealthyThreshold,
+	}
+	if c == nil {
+		return check
+	}
+	if c.Interval > 0 {
+		check.interval = time.Duration(c.Interval)
+	}
+	if c.Timeout > 0 {
+		check.timeout = time.Duration(c.Timeout)
+	}
+	if c.HealthyThreshold > 0 {
+		check.healthyThreshold = c.HealthyThreshold
+	}
+	if c.UnhealthyThreshold > 0 {
+		check.unhealthyThreshold = c.UnhealthyThreshold
+	}
+	check.status = c.Status
+	check.body = c.Body
+	return check
+}
+
+func newServer(b BackendConfig) *Server {
+	s := &Server{
+		URL:        b.URL,
+		Weight:     b.Weight,
+		HealthPath: b.HealthPath,
+		Tags:       b.Tags,
+		check:      newHealthCheck(b.HealthCheck),
+	}
+	if s.Weight == 0 {
+		s.Weight = 1
+	}
+	if s.HealthPath == "" {
+		s.HealthPath = defaultHealthPath
+	}
+	return s
+}
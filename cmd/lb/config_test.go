@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestBuildPool(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		pool, err := buildPool("", "")
+		require.NoError(t, err)
+		require.Len(t, pool, 3)
+		assert.Equal(t, "server1:8080", pool[0].URL)
+		assert.Equal(t, 1, pool[0].Weight)
+		assert.Equal(t, "/health", pool[0].HealthPath)
+	})
+
+	t.Run("Flag", func(t *testing.T) {
+		pool, err := buildPool("a:1, b:2=5", "")
+		require.NoError(t, err)
+		require.Len(t, pool, 2)
+		assert.Equal(t, "b:2", pool[1].URL)
+		assert.Equal(t, 5, pool[1].Weight)
+	})
+
+	t.Run("YAML", func(t *testing.T) {
+		path := writeConfig(t, "lb.yaml", `
+backends:
+  - url: server1:8080
+    weight: 3
+    healthPath: /ready
+    tags: [blue]
+  - url: server2:8080
+`)
+		pool, err := buildPool("", path)
+		require.NoError(t, err)
+		require.Len(t, pool, 2)
+		assert.Equal(t, &Server{URL: "server1:8080", Weight: 3, HealthPath: "/ready", Tags: []string{"blue"}, check: newHealthCheck(nil)}, pool[0])
+		assert.Equal(t, "/health", pool[1].HealthPath)
+	})
+
+	t.Run("JSON and flag", func(t *testing.T) {
+		path := writeConfig(t, "lb.json", `{"backends": [{"url": "server1:8080", "tags": ["green"]}]}`)
+		pool, err := buildPool("server2:8080", path)
+		require.NoError(t, err)
+		require.Len(t, pool, 2)
+		assert.Equal(t, "server2:8080", pool[0].URL)
+		assert.Equal(t, []string{"green"}, pool[1].Tags)
+	})
+
+	t.Run("Health checks", func(t *testing.T) {
+		path := writeConfig(t, "lb.yaml", `
+backends:
+  - url: server1:8080
+    healthCheck:
+      interval: 2s
+      timeout: 500ms
+      status: [200, 204]
+      body: ok
+      healthyThreshold: 3
+      unhealthyThreshold: 1
+`)
+		pool, err := buildPool("", path)
+		require.NoError(t, err)
+		assert.Equal(t, healthCheck{
+			interval:           2 * time.Second,
+			timeout:            500 * time.Millisecond,
+			status:             []int{200, 204},
+			body:               "ok",
+			healthyThreshold:   3,
+			unhealthyThreshold: 1,
+		}, pool[0].check)
+
+		path = writeConfig(t, "lb.json", `{"backends": [{"url": "server1:8080", "healthCheck": {"interval": "1m"}}]}`)
+		pool, err = buildPool("", path)
+		require.NoError(t, err)
+		assert.Equal(t, time.Minute, pool[0].check.interval)
+		assert.Equal(t, defaultUnhealthyThreshold, pool[0].check.unhealthyThreshold)
+	})
+}
+
+func TestBuildPool_Invalid(t *testing.T) {
+	cases := map[string]struct {
+		flag, file, config string
+	}{
+		"No port":          {flag: "server1"},
+		"Bad port":         {flag: "server1:http"},
+		"Duplicate":        {flag: "server1:8080,server1:8080"},
+		"Bad weight":       {flag: "server1:8080=heavy"},
+		"Negative weight":  {flag: "server1:8080=-1"},
+		"Empty":            {flag: ",", file: "lb.json", config: `{"backends": []}`},
+		"Unknown field":    {file: "lb.json", config: `{"backends": [{"url": "a:1", "wieght": 2}]}`},
+		"Unknown format":   {file: "lb.toml", config: `backends = []`},
+		"Bad health path":  {file: "lb.yml", config: "backends:\n  - url: a:1\n    healthPath: health\n"},
+		"Malformed config": {file: "lb.yaml", config: "backends: [\n"},
+		"Bad interval":     {file: "lb.json", config: `{"backends": [{"url": "a:1", "healthCheck": {"interval": 5}}]}`},
+		"Bad timeout":      {file: "lb.yaml", config: "backends:\n  - url: a:1\n    healthCheck: {timeout: soon}\n"},
+		"Bad status":       {file: "lb.yaml", config: "backends:\n  - url: a:1\n    healthCheck: {status: [20]}\n"},
+		"Bad threshold":    {file: "lb.yaml", config: "backends:\n  - url: a:1\n    healthCheck: {healthyThreshold: -1}\n"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := ""
+			if c.file != "" {
+				path = writeConfig(t, c.file, c.config)
+			}
+			_, err := buildPool(c.flag, path)
+			assert.Error(t, err)
+		})
+	}
+}
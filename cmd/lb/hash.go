@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// hashKey is the request attribute consistent-hash spreads requests by.
+type hashKey struct {
+	source  string // query, header, path or ip
+	name    string // query parameter or header name
+	segment int    // path segment, counted from 1
+}
+
+// parseHashKey parses query:<param>, header:<name>, path:<segment> or ip.
+func parseHashKey(s string) (hashKey, error) {
+	source, name, _ := strings.Cut(s, ":")
+	switch source {
+	case "ip":
+		if name == "" {
+			return hashKey{source: source}, nil
+		}
+	case "query", "header":
+		if name != "" {
+			return hashKey{source: source, name: name}, nil
+		}
+	case "path":
+		if n, err := strconv.Atoi(name); err == nil && n > 0 {
+			return hashKey{source: source, segment: n}, nil
+		}
+	}
+	return hashKey{}, fmt.Errorf("invalid hash key %q, expected query:<param>, header:<name>, path:<segment> or ip", s)
+}
+
+// value returns the attribute of the request, requests without it are
+// spread by the client address instead.
+func (k hashKey) value(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	var v string
+	switch k.source {
+	case "query":
+		v = r.URL.Query().Get(k.name)
+	case "header":
+		v = r.Header.Get(k.name)
+	case "path":
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if k.segment <= len(segments) {
+			v = segments[k.segment-1]
+		}
+	}
+	if v != "" {
+		return v
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// consistentHash sends the requests with the same key to the same backend
+// using weighted rendezvous hashing: every backend scores the key and the
+// highest score wins. When a backend goes away only its keys move, they
+// go to the backends that scored second for them.
+type consistentHash struct {
+	key hashKey
+}
+
+func (s *consistentHash) Pick(pool []*Server, r *http.Request, tried ...*Server) int {
+	key := s.key.value(r)
+	best, bestScore := -1, math.Inf(-1)
+	for i, server := range pool {
+		if !usable(server, tried) {
+			continue
+		}
+		if score := rendezvousScore(key, server); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// rendezvousScore is weight / -ln(u) for a uniform u in (0, 1) hashed from
+// the key and the backend, which makes every backend win the share of keys
+// proportional to its weight.
+func rendezvousScore(key string, s *Server) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(s.URL))
+	u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+
+	weight := s.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	return float64(weight) / -math.Log(u)
+}
+
+// mix64 is the finalizer of splitmix64, FNV alone mixes the last bytes poorly.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
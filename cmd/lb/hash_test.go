@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHashKey(t *testing.T) {
+	for s, expected := range map[string]hashKey{
+		"query:key":     {source: "query", name: "key"},
+		"header:X-User": {source: "header", name: "X-User"},
+		"path:2":        {source: "path", segment: 2},
+		"ip":            {source: "ip"},
+	} {
+		key, err := parseHashKey(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, key, s)
+	}
+
+	for _, s := range []string{"", "query", "query:", "header:", "path:0", "path:x", "ip:1", "cookie:id"} {
+		_, err := parseHashKey(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestHashKey_Value(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=team", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-User", "alice")
+
+	for s, expected := range map[string]string{
+		"query:key":     "team",
+		"header:X-User": "alice",
+		"path:3":        "some-data",
+		"ip":            "10.0.0.1",
+		"query:other":   "10.0.0.1",
+		"path:4":        "10.0.0.1",
+	} {
+		key, _ := parseHashKey(s)
+		assert.Equal(t, expected, key.value(r), s)
+	}
+}
+
+func requestWithKey(key string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key="+key, nil)
+}
+
+func TestConsistentHash(t *testing.T) {
+	pool := []*Server{
+		{URL: "server1:8080", Healthy: true, Weight: 1},
+		{URL: "server2:8080", Healthy: true, Weight: 1},
+		{URL: "server3:8080", Healthy: true, Weight: 1},
+	}
+	s := &consistentHash{key: hashKey{source: "query", name: "key"}}
+
+	const keys = 3000
+	before := make([]int, keys)
+	counts := make(map[int]int)
+	for i := range before {
+		before[i] = s.Pick(pool, requestWithKey(fmt.Sprint("key", i)))
+		counts[before[i]]++
+	}
+
+	t.Run("Same key, same backend", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, before[42], s.Pick(pool, requestWithKey("key42")))
+		}
+	})
+
+	t.Run("Keys are spread", func(t *testing.T) {
+		for i := range pool {
+			assert.InDelta(t, keys/3, counts[i], keys/10, pool[i].URL)
+		}
+	})
+
+	t.Run("Only the keys of an unhealthy backend move", func(t *testing.T) {
+		pool[1].Healthy = false
+		defer func() { pool[1].Healthy = true }()
+		for i := range before {
+			got := s.Pick(pool, requestWithKey(fmt.Sprint("key", i)))
+			if before[i] == 1 {
+				assert.NotEqual(t, 1, got)
+			} else {
+				assert.Equal(t, before[i], got)
+			}
+		}
+	})
+
+	t.Run("Weights", func(t *testing.T) {
+		pool[0].Weight = 2
+		defer func() { pool[0].Weight = 1 }()
+		counts := make(map[int]int)
+		for i := 0; i < keys; i++ {
+			counts[s.Pick(pool, requestWithKey(fmt.Sprint("key", i)))]++
+		}
+		assert.InDelta(t, keys/2, counts[0], keys/10)
+	})
+}
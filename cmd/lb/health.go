@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxHealthBody is how much of a health check answer is searched for the
+// expected body.
+const maxHealthBody = 64 << 10
+
+// healthCheck is the active health check of a backend, the path is
+// Server.HealthPath.
+type healthCheck struct {
+	interval time.Duration
+	timeout  time.Duration
+	status   []int  // expected status codes, 200 if there are none
+	body     string // expected in the answer if not empty
+
+	// results in a row changing the health, the first check decides alone
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+// period is the interval between the checks.
+func (c healthCheck) period() time.Duration {
+	if c.interval <= 0 {
+		return healthCheckInterval
+	}
+	return c.interval
+}
+
+// probe sends the health check to the backend without touching its state.
+func probe(url, path string, check healthCheck) error {
+	if path == "" {
+		path = defaultHealthPath
+	}
+	t := check.timeout
+	if t <= 0 {
+		t = timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s", scheme(), url, path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !expectedStatus(check.status, resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if check.body != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), check.body) {
+			return fmt.Errorf("answer doesn't contain %q", check.body)
+		}
+	}
+	return nil
+}
+
+func expectedStatus(expected []int, status int) bool {
+	if len(expected) == 0 {
+		return status == http.StatusOK
+	}
+	for _, code := range expected {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHealth probes the backend and updates its health, mutex isn't held
+// while waiting for the backend.
+func checkHealth(s *Server) {
+	mutex.Lock()
+	path, check := s.HealthPath, s.check
+	mutex.Unlock()
+
+	err := probe(s.URL, path, check)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	s.lastCheck = time.Now()
+	s.recordProbe(err)
+}
+
+// recordProbe counts the result of a health check and logs the changes of
+// the health, the caller holds mutex.
+func (s *Server) recordProbe(err error) {
+	if err == nil {
+		s.probeSuccesses++
+		s.probeFailures = 0
+	} else {
+		s.probeFailures++
+		s.probeSuccesses = 0
+	}
+
+	healthy := s.Healthy
+	switch {
+	case !s.probed:
+		healthy = err == nil
+	case err == nil && s.probeSuccesses >= threshold(s.check.healthyThreshold):
+		healthy = true
+	case err != nil && s.probeFailures >= threshold(s.check.unhealthyThreshold):
+		healthy = false
+	}
+	if healthy != s.Healthy || !s.probed {
+		if healthy {
+			log.Printf("Backend %s is healthy", s.URL)
+		} else {
+			log.Printf("Backend %s is unhealthy: %s", s.URL, err)
+		}
+	}
+	s.probed = true
+	s.Healthy = healthy
+}
+
+func threshold(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// jitter spreads the health checks of the backends so they don't align,
+// it returns d changed by up to a tenth.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 10)
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread+1))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder(http.MethodGet, "http://server1:8080/ready",
+		httpmock.NewStringResponder(http.StatusNoContent, ""))
+	httpmock.RegisterResponder(http.MethodGet, "http://server1:8080/status",
+		httpmock.NewStringResponder(http.StatusOK, `{"status": "degraded"}`))
+
+	assert.Error(t, probe("server1:8080", "/ready", healthCheck{}), "200 is expected by default")
+	assert.NoError(t, probe("server1:8080", "/ready", healthCheck{status: []int{200, 204}}))
+	assert.NoError(t, probe("server1:8080", "/status", healthCheck{body: "degraded"}))
+	assert.Error(t, probe("server1:8080", "/status", healthCheck{body: `"ok"`}))
+	assert.Error(t, probe("server1:8080", "/missing", healthCheck{}))
+}
+
+func TestRecordProbe(t *testing.T) {
+	s := &Server{URL: "server1:8080", check: healthCheck{healthyThreshold: 2, unhealthyThreshold: 3}}
+	failed := errors.New("unexpected status 500")
+
+	steps := []struct {
+		err     error
+		healthy bool
+	}{
+		{nil, true}, // the first check decides alone
+		{failed, true},
+		{failed, true},
+		{nil, true},
+		{failed, true},
+		{failed, true},
+		{failed, false},
+		{nil, false},
+		{failed, false},
+		{nil, false},
+		{nil, true},
+	}
+	for i, step := range steps {
+		s.recordProbe(step.err)
+		assert.Equal(t, step.healthy, s.Healthy, "step %d", i)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(10 * time.Second)
+		assert.GreaterOrEqual(t, d, 9*time.Second)
+		assert.LessOrEqual(t, d, 11*time.Second)
+	}
+	assert.Equal(t, time.Duration(5), jitter(5))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeSamples    = 1000 // latencies the percentile is computed from
+	hedgeMinSamples = 50   // no hedging until there are as many
+	hedgeRecompute  = 100  // the percentile is computed again after as many samples
+)
+
+// hedger keeps the recent latencies of the backends and tells how long to
+// wait for an answer before hedging a request.
+type hedger struct {
+	percentile float64
+	minDelay   time.Duration
+
+	mu       sync.Mutex
+	samples  []time.Duration // ring of the latest latencies
+	next     int
+	fresh    int // samples since the delay was computed
+	computed time.Duration
+}
+
+// hedging is nil when hedging is disabled.
+var (
+	hedging     *hedger
+	hedgeTokens = newRetryBudget(0.05)
+)
+
+func newHedger(percentile float64, minDelay time.Duration) *hedger {
+	return &hedger{percentile: percentile, minDelay: minDelay, samples: make([]time.Duration, 0, hedgeSamples)}
+}
+
+func (h *hedger) observe(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.next] = latency
+		h.next = (h.next + 1) % hedgeSamples
+	}
+	h.fresh++
+}
+
+// delay returns how long to wait before hedging, false if there are too
+// few samples to tell.
+func (h *hedger) delay() (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeMinSamples {
+		return 0, false
+	}
+	if h.computed == 0 || h.fresh >= hedgeRecompute {
+		sorted := append([]time.Duration(nil), h.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := int(math.Ceil(h.percentile/100*float64(len(sorted)))) - 1 // nearest rank
+		if i < 0 {
+			i = 0
+		} else if i >= len(sorted) {
+			i = len(sorted) - 1
+		}
+		h.computed, h.fresh = sorted[i], 0
+	}
+	if h.computed < h.minDelay {
+		return h.minDelay, true
+	}
+	return h.computed, true
+}
+
+// hedgeable reports whether the request can be sent twice.
+func hedgeable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// hedged sends the request to dst and, if it doesn't answer within the
+// delay, to a second backend too. The first answer wins and the other
+// request is cancelled. The second backend is chosen like the first one
+// skipping the ones in tried, the hedges are limited by hedgeTokens. It
+// returns the backends the request was sent to as well.
+func hedged(r *http.Request, dst *Server, repin bool, tried []*Server) (*attempt, []*Server) {
+	used := []*Server{dst}
+	hedgeTokens.deposit()
+	results := make(chan *attempt, 2)
+	first := newAttempt(r, dst, repin)
+	go func() {
+		first.run()
+		results <- first
+	}()
+
+	wait, ok := hedging.delay()
+	if !ok {
+		return <-results, used
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case a := <-results:
+		return a, used
+	case <-timer.C:
+	}
+	if !hedgeTokens.withdraw() {
+		return <-results, used
+	}
+
+	mutex.Lock()
+	other, otherRepin := pickBackend(serversPool, r, append(used, tried...)...)
+	if other == nil {
+		mutex.Unlock()
+		return <-results, used
+	}
+	other.ConnCnt++
+	other.active++
+	breakers.acquire(other)
+	mutex.Unlock()
+	hedgesTotal.Inc()
+	used = append(used, other)
+
+	second := newAttempt(r, other, otherRepin)
+	go func() {
+		second.run()
+		results <- second
+	}()
+
+	winner := <-results
+	if winner.err != nil {
+		// the other one may still answer
+		winner.finish()
+		return <-results, used
+	}
+	loser := first
+	if winner == first {
+		loser = second
+	}
+	loser.cancel()
+	go func() {
+		<-results
+		loser.finish()
+	}()
+	return winner, used
+}
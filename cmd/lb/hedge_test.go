@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedger_Delay(t *testing.T) {
+	h := newHedger(90, time.Millisecond)
+	_, ok := h.delay()
+	assert.False(t, ok, "too few samples")
+
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	delay, ok := h.delay()
+	assert.True(t, ok)
+	assert.Equal(t, 90*time.Millisecond, delay)
+
+	h.minDelay = time.Second
+	delay, _ = h.delay()
+	assert.Equal(t, time.Second, delay)
+}
+
+func TestHedgeable(t *testing.T) {
+	assert.True(t, hedgeable(httptest.NewRequest(http.MethodGet, "/", nil)))
+	assert.True(t, hedgeable(httptest.NewRequest(http.MethodHead, "/", nil)))
+	assert.False(t, hedgeable(httptest.NewRequest(http.MethodPost, "/", nil)))
+	assert.False(t, hedgeable(httptest.NewRequest(http.MethodGet, "/", strings.NewReader("body"))), "bodies must be buffered")
+}
+
+func TestForward_Hedged(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var cancelled int32
+	httpmock.RegisterResponder("GET", "http://server1:8080/", func(r *http.Request) (*http.Response, error) {
+		select {
+		case <-time.After(time.Second):
+			return httpmock.NewStringResponse(200, "server1"), nil
+		case <-r.Context().Done():
+			atomic.AddInt32(&cancelled, 1)
+			return nil, r.Context().Err()
+		}
+	})
+	httpmock.RegisterResponder("GET", "http://server2:8080/", httpmock.NewStringResponder(200, "server2"))
+
+	savedHedging, savedTokens := hedging, hedgeTokens
+	defer func() { hedging, hedgeTokens = savedHedging, savedTokens }()
+	hedging = newHedger(95, time.Millisecond)
+	for i := 0; i < hedgeMinSamples; i++ {
+		hedging.observe(5 * time.Millisecond)
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		serversPool = []*Server{
+			{URL: "server1:8080", Healthy: true},
+			{URL: "server2:8080", Healthy: true},
+		}
+		rr := httptest.NewRecorder()
+		require.NoError(t, forward(rr, httptest.NewRequest(http.MethodGet, "/", nil)))
+		return rr
+	}
+
+	t.Run("The faster answer wins", func(t *testing.T) {
+		hedgeTokens = newRetryBudget(0.05)
+		start := time.Now()
+		rr := send()
+		assert.Equal(t, "server2", rr.Body.String())
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+		slow := serversPool[0]
+		assert.Eventually(t, func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return slow.active == 0
+		}, time.Second, 10*time.Millisecond, "the slow request is cancelled")
+		assert.EqualValues(t, 1, atomic.LoadInt32(&cancelled))
+		assert.Zero(t, slow.errors, "cancelled requests aren't failures")
+	})
+
+	t.Run("Hedge rate cap", func(t *testing.T) {
+		hedgeTokens = &retryBudget{ratio: 0}
+		rr := send()
+		assert.Equal(t, "server1", rr.Body.String())
+	})
+}
+
+func TestForward_HedgedProbe(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "http://server1:8080/", func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+	httpmock.RegisterResponder("GET", "http://server2:8080/", httpmock.NewStringResponder(200, "server2"))
+
+	savedHedging, savedTokens := hedging, hedgeTokens
+	defer func() { hedging, hedgeTokens = savedHedging, savedTokens }()
+	hedging = newHedger(95, time.Millisecond)
+	for i := 0; i < hedgeMinSamples; i++ {
+		hedging.observe(5 * time.Millisecond)
+	}
+	hedgeTokens = newRetryBudget(1)
+
+	now := withBreakers(t)
+	half := &Server{URL: "server1:8080", Healthy: true}
+	serversPool = []*Server{half, {URL: "server2:8080", Healthy: true}}
+	halfOpen(half, now)
+
+	for i := 0; i < breakers.probes+1; i++ {
+		rr := httptest.NewRecorder()
+		require.NoError(t, forward(rr, httptest.NewRequest(http.MethodGet, "/", nil)))
+		assert.Equal(t, "server2", rr.Body.String())
+	}
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return half.active == 0
+	}, time.Second, 10*time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, circuitHalfOpen, breakers.state(half))
+	assert.Zero(t, half.breaker.probing, "the hedges that lost don't keep the probe slots")
+	assert.True(t, available(half))
+}
+
+func TestForward_HedgedRetry(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "http://server1:8080/", func(r *http.Request) (*http.Response, error) {
+		time.Sleep(50 * time.Millisecond)
+		return nil, errors.New("connection reset")
+	})
+	httpmock.RegisterResponder("GET", "http://server2:8080/", httpmock.NewErrorResponder(errors.New("connection reset")))
+	httpmock.RegisterResponder("GET", "http://server3:8080/", httpmock.NewStringResponder(200, "server3"))
+
+	savedHedging, savedTokens, savedRetries := hedging, hedgeTokens, retryTokens
+	defer func() { hedging, hedgeTokens, retryTokens = savedHedging, savedTokens, savedRetries }()
+	hedging = newHedger(95, time.Millisecond)
+	for i := 0; i < hedgeMinSamples; i++ {
+		hedging.observe(5 * time.Millisecond)
+	}
+	hedgeTokens = newRetryBudget(0.05)
+	retryTokens = newRetryBudget(0.2)
+
+	serversPool = []*Server{
+		{URL: "server1:8080", Healthy: true},
+		{URL: "server2:8080", Healthy: true},
+		// least-connections would retry on server2 if it wasn't known to have failed
+		{URL: "server3:8080", Healthy: true, ConnCnt: 100},
+	}
+	rr := httptest.NewRecorder()
+	require.NoError(t, forward(rr, httptest.NewRequest(http.MethodGet, "/", nil)))
+	assert.Equal(t, "server3", rr.Body.String())
+	info := httpmock.GetCallCountInfo()
+	assert.Equal(t, 1, info["GET http://server1:8080/"])
+	assert.Equal(t, 1, info["GET http://server2:8080/"], "the failed hedge isn't retried")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets is the number of clients after which the rate limiter
+// forgets the ones with full buckets.
+const maxRateBuckets = 10000
+
+// rateLimiter is a token bucket per client: a client can send burst
+// requests at once and rate requests a second after that.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	key   hashKey
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimit is nil when rate limiting is disabled.
+var rateLimit *rateLimiter
+
+// newRateLimiter returns nil if rate isn't positive, key is accepted by
+// parseHashKey and clients without it are limited by their address.
+func newRateLimiter(rate float64, burst int, key string) (*rateLimiter, error) {
+	if rate <= 0 {
+		return nil, nil
+	}
+	k, err := parseHashKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		key:     k,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}, nil
+}
+
+// allow takes a token of the client, if there is none it returns how long
+// until there is one.
+func (l *rateLimiter) allow(r *http.Request) (bool, time.Duration) {
+	key := l.key.value(r)
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed.Seconds()*l.rate)
+		b.last = now
+	}
+}
+
+// sweep forgets the clients whose buckets are full again.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// inFlightLimits caps the requests in flight, to all backends and to each
+// of them. Requests over a limit wait up to queueTimeout for a free slot.
+type inFlightLimits struct {
+	global       chan struct{} // nil if unlimited
+	perBackend   int           // 0 if unlimited
+	queueTimeout time.Duration
+}
+
+var (
+	inFlight = newInFlightLimits(0, 0, 100*time.Millisecond)
+
+	// slotFreed is signalled when a request to a backend finishes.
+	slotFreed = sync.NewCond(&mutex)
+)
+
+func newInFlightLimits(global, perBackend int, queueTimeout time.Duration) *inFlightLimits {
+	l := &inFlightLimits{perBackend: perBackend, queueTimeout: queueTimeout}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	return l
+}
+
+// acquire takes a global slot, waiting up to queueTimeout for one.
+func (l *inFlightLimits) acquire(ctx context.Context) bool {
+	if l.global == nil {
+		return true
+	}
+	select {
+	case l.global <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.global <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (l *inFlightLimits) release() {
+	if l.global != nil {
+		<-l.global
+	}
+}
+
+// full reports whether the backend is at its limit, the caller holds mutex.
+func (l *inFlightLimits) full(s *Server) bool {
+	return l.perBackend > 0 && s.active >= l.perBackend
+}
+
+// saturated reports whether a backend of the pool would be available if it
+// wasn't at its limit, the caller holds mutex.
+func saturated(pool []*Server) bool {
+	for _, s := range pool {
+		if ready(s) && inFlight.full(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForBackend waits up to queueTimeout for a backend at its limit to
+// finish a request, the caller holds mutex.
+func waitForBackend(r *http.Request) (*Server, bool) {
+	deadline := time.Now().Add(inFlight.queueTimeout)
+	for saturated(serversPool) && r.Context().Err() == nil {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		timer := time.AfterFunc(wait, slotFreed.Broadcast)
+		slotFreed.Wait()
+		timer.Stop()
+		if dst, repin := pickBackend(serversPool, r); dst != nil {
+			return dst, repin
+		}
+	}
+	return nil, false
+}
+
+// limit applies the rate limit and the global in-flight limit and forwards
+// the requests within them.
+func limit(rw http.ResponseWriter, r *http.Request) error {
+	if rateLimit != nil {
+		if ok, wait := rateLimit.allow(r); !ok {
+			rejectedTotal.With("rate").Inc()
+			setRetryAfter(rw, wait)
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return fmt.Errorf("rate limit of %s exceeded", rateLimit.key.value(r))
+		}
+	}
+	if !inFlight.acquire(r.Context()) {
+		rejectedTotal.With("in-flight").Inc()
+		setRetryAfter(rw, time.Second)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return fmt.Errorf("too many requests in flight")
+	}
+	defer inFlight.release()
+	return forward(rw, r)
+}
+
+// setRetryAfter sets Retry-After in whole seconds, at least one.
+func setRetryAfter(rw http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func clientRequest(ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = ip + ":40000"
+	return r
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, err := newRateLimiter(2, 3, "ip")
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow(clientRequest("10.0.0.1"))
+		assert.True(t, ok, "burst request %d", i)
+	}
+	ok, wait := l.allow(clientRequest("10.0.0.1"))
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = l.allow(clientRequest("10.0.0.2"))
+	assert.True(t, ok, "clients have their own buckets")
+
+	now = now.Add(250 * time.Millisecond)
+	ok, wait = l.allow(clientRequest("10.0.0.1"))
+	assert.False(t, ok)
+	assert.Equal(t, 250*time.Millisecond, wait)
+
+	now = now.Add(250 * time.Millisecond)
+	ok, _ = l.allow(clientRequest("10.0.0.1"))
+	assert.True(t, ok)
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow(clientRequest("10.0.0.1"))
+		assert.True(t, ok, "the bucket holds at most burst tokens")
+	}
+	ok, _ = l.allow(clientRequest("10.0.0.1"))
+	assert.False(t, ok)
+}
+
+func TestRateLimiter_Header(t *testing.T) {
+	l, err := newRateLimiter(1, 1, "header:X-Api-Key")
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	r := clientRequest("10.0.0.1")
+	r.Header.Set("X-Api-Key", "team")
+	ok, _ := l.allow(r)
+	assert.True(t, ok)
+	ok, _ = l.allow(r)
+	assert.False(t, ok)
+
+	other := clientRequest("10.0.0.1")
+	other.Header.Set("X-Api-Key", "other-team")
+	ok, _ = l.allow(other)
+	assert.True(t, ok, "the header identifies the client, not the address")
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	l, _ := newRateLimiter(1, 1, "ip")
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	for i := 0; i < maxRateBuckets; i++ {
+		l.allow(clientRequest(fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&255, i&255)))
+	}
+	now = now.Add(time.Second)
+	l.allow(clientRequest("192.168.0.1"))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	l, err := newRateLimiter(0, 10, "ip")
+	assert.NoError(t, err)
+	assert.Nil(t, l)
+
+	l, err = newRateLimiter(2.5, 0, "ip")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, l.burst)
+
+	_, err = newRateLimiter(1, 1, "cookie:id")
+	assert.Error(t, err)
+}
+
+func TestInFlightLimits_Global(t *testing.T) {
+	l := newInFlightLimits(1, 0, 20*time.Millisecond)
+	assert.True(t, l.acquire(context.Background()))
+	assert.False(t, l.acquire(context.Background()))
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		l.release()
+	}()
+	assert.True(t, l.acquire(context.Background()), "a slot freed while queued")
+}
+
+func TestLimit(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "http://server1:8080/", httpmock.NewStringResponder(200, "OK"))
+
+	savedRate, savedInFlight := rateLimit, inFlight
+	defer func() { rateLimit, inFlight = savedRate, savedInFlight }()
+	serversPool = []*Server{{URL: "server1:8080", Healthy: true}}
+
+	t.Run("Rate limit", func(t *testing.T) {
+		rateLimit, _ = newRateLimiter(1, 1, "ip")
+		defer func() { rateLimit = nil }()
+		rr := httptest.NewRecorder()
+		assert.NoError(t, limit(rr, clientRequest("10.0.0.1")))
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		rr = httptest.NewRecorder()
+		assert.Error(t, limit(rr, clientRequest("10.0.0.1")))
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	})
+
+	t.Run("Global in-flight limit", func(t *testing.T) {
+		inFlight = newInFlightLimits(1, 0, 10*time.Millisecond)
+		require.True(t, inFlight.acquire(context.Background()))
+		defer inFlight.release()
+		rr := httptest.NewRecorder()
+		assert.Error(t, limit(rr, clientRequest("10.0.0.1")))
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	})
+
+	t.Run("Backend in-flight limit", func(t *testing.T) {
+		inFlight = newInFlightLimits(0, 1, 20*time.Millisecond)
+		backend := serversPool[0]
+		mutex.Lock()
+		backend.active = 1
+		mutex.Unlock()
+
+		rr := httptest.NewRecorder()
+		assert.Error(t, limit(rr, clientRequest("10.0.0.1")))
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			backend.active = 0
+			mutex.Unlock()
+			slotFreed.Broadcast()
+		}()
+		rr = httptest.NewRecorder()
+		assert.NoError(t, limit(rr, clientRequest("10.0.0.1")), "the request waits for the slot")
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+}
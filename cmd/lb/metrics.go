@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/Dimdim28/lab4-software-architecture/metrics"
+)
+
+var forwardedTotal = metrics.NewCounterVec("lb_forwarded_requests_total",
+	"Requests forwarded to backends by status code, failed requests have code \"error\".", "backend", "code")
+
+var ejectionsTotal = metrics.NewCounterVec("lb_outlier_ejections_total",
+	"Backends ejected for failing requests in a row.", "backend")
+
+var circuitOpensTotal = metrics.NewCounterVec("lb_circuit_opens_total",
+	"Circuits of backends opened by their circuit breakers.", "backend")
+
+var retriesTotal = metrics.NewCounter("lb_retries_total", "Requests retried on another backend.")
+
+var rejectedTotal = metrics.NewCounterVec("lb_rejected_requests_total",
+	"Requests rejected by the rate limit or the in-flight limit.", "reason")
+
+var hedgesTotal = metrics.NewCounter("lb_hedged_requests_total", "Requests sent to a second backend because the first was slow.")
+
+func registerMetrics() {
+	metrics.NewGaugeVecFunc("lb_backend_healthy", "Whether the backend passes health checks.",
+		[]string{"backend"}, func(observe func(float64, ...string)) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, s := range serversPool {
+				healthy := 0.0
+				if s.Healthy {
+					healthy = 1
+				}
+				observe(healthy, s.URL)
+			}
+		})
+	metrics.NewGaugeVecFunc("lb_backend_ejected", "Whether the backend is ejected for failing requests.",
+		[]string{"backend"}, func(observe func(float64, ...string)) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, s := range serversPool {
+				ejected := 0.0
+				if outliers.ejected(s) {
+					ejected = 1
+				}
+				observe(ejected, s.URL)
+			}
+		})
+	metrics.NewGaugeVecFunc("lb_backend_circuit_state", "State of the circuit of the backend: 0 closed, 1 open, 2 half-open.",
+		[]string{"backend"}, func(observe func(float64, ...string)) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, s := range serversPool {
+				observe(float64(breakers.state(s)), s.URL)
+			}
+		})
+	metrics.NewGaugeVecFunc("lb_backend_conn_cnt", "ConnCnt of the backend, requests forwarded to it.",
+		[]string{"backend"}, func(observe func(float64, ...string)) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, s := range serversPool {
+				observe(float64(s.ConnCnt), s.URL)
+			}
+		})
+}
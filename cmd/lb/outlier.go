@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// outlierDetection ejects backends failing live requests without waiting
+// for the health checks. A backend is ejected after failures 5xx answers,
+// timeouts or connection errors in a row for baseTime, doubled with every
+// ejection up to maxTime. At most maxPercent of the pool is ejected at once.
+type outlierDetection struct {
+	failures   int // 0 disables ejection
+	baseTime   time.Duration
+	maxTime    time.Duration
+	maxPercent int
+	now        func() time.Time
+}
+
+var outliers = &outlierDetection{
+	failures:   5,
+	baseTime:   30 * time.Second,
+	maxTime:    5 * time.Minute,
+	maxPercent: 50,
+	now:        time.Now,
+}
+
+func (o *outlierDetection) ejected(s *Server) bool {
+	return s.ejectedUntil.After(o.now())
+}
+
+// record updates the failures in a row of the backend and ejects it when
+// there are too many, the caller holds mutex.
+func (o *outlierDetection) record(s *Server, failed bool) {
+	if !failed {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if o.failures <= 0 || s.failures < o.failures || o.ejected(s) {
+		return
+	}
+	if !o.canEject() {
+		log.Printf("Backend %s is failing, but %d%% of the backends are ejected already", s.URL, o.maxPercent)
+		return
+	}
+
+	now := o.now()
+	if now.Sub(s.ejectedUntil) > o.maxTime {
+		s.ejections = 0 // behaved long enough to start over
+	}
+	ejection := o.baseTime
+	for i := 0; i < s.ejections && ejection < o.maxTime; i++ {
+		ejection *= 2
+	}
+	if ejection > o.maxTime {
+		ejection = o.maxTime
+	}
+	s.ejections++
+	s.ejectedUntil = now.Add(ejection)
+	s.failures = 0
+	ejectionsTotal.With(s.URL).Inc()
+	log.Printf("Backend %s ejected for %s after %d failures in a row", s.URL, ejection, o.failures)
+}
+
+// canEject reports whether one more backend of the pool can be ejected.
+func (o *outlierDetection) canEject() bool {
+	ejected := 0
+	for _, s := range serversPool {
+		if o.ejected(s) {
+			ejected++
+		}
+	}
+	return (ejected+1)*100 <= o.maxPercent*len(serversPool)
+}
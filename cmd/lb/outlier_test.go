@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withOutliers(t *testing.T, pool []*Server) *time.Time {
+	now := time.Unix(1700000000, 0)
+	saved := outliers
+	outliers = &outlierDetection{
+		failures:   3,
+		baseTime:   10 * time.Second,
+		maxTime:    time.Minute,
+		maxPercent: 50,
+		now:        func() time.Time { return now },
+	}
+	serversPool = pool
+	t.Cleanup(func() { outliers = saved })
+	return &now
+}
+
+func fail(s *Server, times int) {
+	for i := 0; i < times; i++ {
+		recordResult(s, true, 0)
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	pool := []*Server{
+		{URL: "server1:8080", Healthy: true},
+		{URL: "server2:8080", Healthy: true},
+		{URL: "server3:8080", Healthy: true},
+	}
+	now := withOutliers(t, pool)
+	s := pool[0]
+
+	t.Run("Successes reset the failures", func(t *testing.T) {
+		fail(s, 2)
+		recordResult(s, false, 0)
+		fail(s, 2)
+		assert.True(t, available(s))
+		assert.Equal(t, 4, s.errors)
+	})
+
+	t.Run("Ejection", func(t *testing.T) {
+		fail(s, 1)
+		assert.False(t, available(s))
+		assert.Equal(t, now.Add(10*time.Second), s.ejectedUntil)
+		assert.Equal(t, 1, findBestServer(pool))
+
+		*now = now.Add(10 * time.Second)
+		assert.True(t, available(s))
+	})
+
+	t.Run("Ejections grow exponentially", func(t *testing.T) {
+		for _, expected := range []time.Duration{20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+			fail(s, 3)
+			assert.Equal(t, now.Add(expected), s.ejectedUntil)
+			*now = s.ejectedUntil
+		}
+	})
+
+	t.Run("Reset after behaving", func(t *testing.T) {
+		*now = now.Add(2 * time.Minute)
+		fail(s, 3)
+		assert.Equal(t, now.Add(10*time.Second), s.ejectedUntil)
+	})
+
+	t.Run("Max ejection percentage", func(t *testing.T) {
+		fail(pool[1], 3)
+		assert.True(t, available(pool[1]), "a third ejected backend would be above 50%")
+		*now = s.ejectedUntil
+		fail(pool[1], 1)
+		assert.False(t, available(pool[1]))
+	})
+}
+
+func TestOutlierDetection_Disabled(t *testing.T) {
+	pool := []*Server{
+		{URL: "server1:8080", Healthy: true},
+		{URL: "server2:8080", Healthy: true},
+	}
+	withOutliers(t, pool)
+	outliers.failures = 0
+	fail(pool[0], 10)
+	assert.True(t, available(pool[0]))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// viaName is the pseudonym of the balancer in the Via headers.
+const viaName = "lb"
+
+// hopHeaders are meaningful only for a single connection and aren't
+// forwarded, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers and the ones listed in
+// Connection.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// hasToken reports whether the comma separated header values contain the
+// token, ignoring case.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			if name, _, _ := strings.Cut(t, ";"); strings.EqualFold(strings.TrimSpace(name), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyRequestHeaders prepares the headers of a request forwarded to a
+// backend: it removes the hop-by-hop ones and tells the backend about the
+// client and the balancer.
+func proxyRequestHeaders(out, in *http.Request) {
+	trailers := hasToken(in.Header.Values("Te"), "trailers")
+	removeHopHeaders(out.Header)
+	if trailers {
+		// the client can take trailers, so the backend can send them
+		out.Header.Set("Te", "trailers")
+	}
+
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	client, _, err := net.SplitHostPort(in.RemoteAddr)
+	if err != nil {
+		client = in.RemoteAddr
+	}
+	if client != "" {
+		if prior := in.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			out.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+client)
+		} else {
+			out.Header.Set("X-Forwarded-For", client)
+		}
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", in.Host)
+
+	element := "for=" + forwardedNode(client) + ";host=" + quoteForwarded(in.Host) + ";proto=" + proto
+	if prior := in.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	out.Header.Set("Forwarded", element)
+	addVia(out.Header, in.ProtoMajor, in.ProtoMinor)
+}
+
+// proxyResponseHeaders copies the headers of a backend response without the
+// hop-by-hop ones and announces its trailers.
+func proxyResponseHeaders(dst http.Header, resp *http.Response) {
+	removeHopHeaders(resp.Header)
+	for k, values := range resp.Header {
+		for _, value := range values {
+			dst.Add(k, value)
+		}
+	}
+	for k := range resp.Trailer {
+		dst.Add("Trailer", k)
+	}
+	addVia(dst, resp.ProtoMajor, resp.ProtoMinor)
+}
+
+// copyTrailers sets the trailers of a backend response once its body is
+// read, the ones not announced before the body are sent as well.
+func copyTrailers(dst http.Header, resp *http.Response) {
+	announced := make(map[string]bool)
+	for _, value := range dst.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			announced[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for k, values := range resp.Trailer {
+		if !announced[k] {
+			k = http.TrailerPrefix + k
+		}
+		dst[k] = values
+	}
+}
+
+func addVia(h http.Header, major, minor int) {
+	version := "1.1"
+	if major != 0 {
+		version = strconv.Itoa(major)
+		if major == 1 {
+			version += "." + strconv.Itoa(minor)
+		}
+	}
+	h.Add("Via", version+" "+viaName)
+}
+
+// forwardedNode formats a client address as a node of the Forwarded
+// header, RFC 7239 section 6.
+func forwardedNode(addr string) string {
+	if addr == "" {
+		return "unknown"
+	}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return `"[` + addr + `]"`
+	}
+	return quoteForwarded(addr)
+}
+
+// quoteForwarded quotes a value of the Forwarded header unless it is a
+// token.
+func quoteForwarded(value string) string {
+	if value != "" && strings.IndexFunc(value, notToken) < 0 {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// notToken reports whether the rune can't be in a token, RFC 7230 section
+// 3.2.6.
+func notToken(c rune) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return false
+	}
+	return !strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":        {"keep-alive, X-Secret"},
+		"Keep-Alive":        {"timeout=5"},
+		"Proxy-Connection":  {"keep-alive"},
+		"Transfer-Encoding": {"chunked"},
+		"Upgrade":           {"websocket"},
+		"X-Secret":          {"hop"},
+		"Content-Type":      {"text/plain"},
+	}
+	removeHopHeaders(h)
+	assert.Equal(t, http.Header{"Content-Type": {"text/plain"}}, h)
+}
+
+func TestProxyRequestHeaders(t *testing.T) {
+	in := httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+	in.RemoteAddr = "10.0.0.2:40000"
+	in.Header.Set("Connection", "X-Hop")
+	in.Header.Set("X-Hop", "1")
+	in.Header.Set("Te", "gzip, trailers")
+	in.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	in.Header.Set("X-Forwarded-For", "10.0.0.1")
+	in.Header.Set("Forwarded", "for=10.0.0.1")
+	in.Header.Set("Via", "1.0 edge")
+
+	out := in.Clone(in.Context())
+	proxyRequestHeaders(out, in)
+	assert.Empty(t, out.Header.Get("X-Hop"))
+	assert.Empty(t, out.Header.Get("Connection"))
+	assert.Empty(t, out.Header.Get("Proxy-Authorization"))
+	assert.Equal(t, "trailers", out.Header.Get("Te"))
+	assert.Equal(t, "10.0.0.1, 10.0.0.2", out.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "http", out.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "example.com", out.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "for=10.0.0.1, for=10.0.0.2;host=example.com;proto=http", out.Header.Get("Forwarded"))
+	assert.Equal(t, []string{"1.0 edge", "1.1 lb"}, out.Header.Values("Via"))
+	assert.Equal(t, "10.0.0.1", in.Header.Get("X-Forwarded-For"), "the client request is left as is")
+
+	t.Run("IPv6 over TLS", func(t *testing.T) {
+		in := httptest.NewRequest(http.MethodGet, "https://lb.example:8443/", nil)
+		in.RemoteAddr = "[2001:db8::1]:40000"
+		in.TLS = &tls.ConnectionState{}
+		in.ProtoMajor, in.ProtoMinor = 2, 0
+		out := in.Clone(in.Context())
+		proxyRequestHeaders(out, in)
+		assert.Equal(t, "2001:db8::1", out.Header.Get("X-Forwarded-For"))
+		assert.Equal(t, "https", out.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, `for="[2001:db8::1]";host="lb.example:8443";proto=https`, out.Header.Get("Forwarded"))
+		assert.Equal(t, "2 lb", out.Header.Get("Via"))
+		assert.Empty(t, out.Header.Get("Te"), "the client can't take trailers")
+	})
+}
+
+func TestQuoteForwarded(t *testing.T) {
+	assert.Equal(t, "example.com", quoteForwarded("example.com"))
+	assert.Equal(t, `"example.com:80"`, quoteForwarded("example.com:80"))
+	assert.Equal(t, `"a\"b"`, quoteForwarded(`a"b`))
+	assert.Equal(t, `""`, quoteForwarded(""))
+	assert.Equal(t, "unknown", forwardedNode(""))
+}
+
+func TestForward_Proxy(t *testing.T) {
+	var received *http.Request
+	var receivedBody string
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received, receivedBody = r, string(body)
+		rw.Header().Set("Connection", "X-Backend-Hop")
+		rw.Header().Set("X-Backend-Hop", "1")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.Write([]byte("body"))
+		rw.Header().Set("X-Checksum", "abc")
+		rw.Header().Set(http.TrailerPrefix+"X-Late", "late")
+	}))
+	defer backend.Close()
+	frontend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		forward(rw, r)
+	}))
+	defer frontend.Close()
+	serversPool = []*Server{{URL: strings.TrimPrefix(backend.URL, "http://"), Healthy: true}}
+
+	req, err := http.NewRequest(http.MethodPost, frontend.URL+"/upload", io.NopCloser(strings.NewReader("data")))
+	require.NoError(t, err)
+	req.ContentLength = -1
+	req.Trailer = http.Header{"X-Request-Sum": {"123"}}
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Connection", "X-Client-Hop")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, "data", receivedBody)
+	assert.Equal(t, "123", received.Trailer.Get("X-Request-Sum"), "request trailers are forwarded")
+	assert.Empty(t, received.Header.Get("X-Client-Hop"))
+	assert.Equal(t, "127.0.0.1", received.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "http", received.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, strings.TrimPrefix(frontend.URL, "http://"), received.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "1.1 lb", received.Header.Get("Via"))
+
+	assert.Equal(t, "body", string(body))
+	assert.Empty(t, resp.Header.Get("X-Backend-Hop"))
+	assert.Empty(t, resp.Header.Get("Keep-Alive"))
+	assert.Equal(t, "1.1 lb", resp.Header.Get("Via"))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	assert.Equal(t, "late", resp.Trailer.Get("X-Late"), "trailers not announced are forwarded too")
+}
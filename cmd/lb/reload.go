@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+const healthCheckInterval = 10 * time.Second
+
+// startHealthChecks probes the backend until it is stopped, at its interval
+// with some jitter.
+func startHealthChecks(s *Server) {
+	stop := make(chan struct{})
+	s.stop = stop
+	interval := s.check.period()
+	go func() {
+		timer := time.NewTimer(jitter(interval))
+		defer timer.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-timer.C:
+			}
+			checkHealth(s)
+			mutex.Lock()
+			interval = s.check.period()
+			mutex.Unlock()
+			timer.Reset(jitter(interval))
+		}
+	}()
+}
+
+// reloadPool rebuilds the pool from the flags and the config file. Backends
+// that stay keep their health and connection counts, new ones join once
+// they pass a health check and removed ones only get the requests they are
+// already serving. The current pool is kept if the new one is invalid.
+func reloadPool() {
+	pool, err := buildPool(*backends, *configPath)
+	if err != nil {
+		log.Printf("Keeping the current backends, reload failed: %s", err)
+		return
+	}
+
+	mutex.Lock()
+	current := make(map[string]*Server, len(serversPool))
+	for _, s := range serversPool {
+		current[s.URL] = s
+	}
+	var added []*Server
+	for i, s := range pool {
+		if old, ok := current[s.URL]; ok {
+			old.Weight, old.HealthPath, old.Tags, old.check = s.Weight, s.HealthPath, s.Tags, s.check
+			pool[i] = old
+			delete(current, s.URL)
+		} else {
+			added = append(added, s)
+		}
+	}
+	serversPool = pool
+	for _, s := range current {
+		if s.stop != nil {
+			close(s.stop)
+			s.stop = nil
+		}
+	}
+	for _, s := range added {
+		startHealthChecks(s)
+	}
+	mutex.Unlock()
+
+	for _, s := range added {
+		go checkHealth(s)
+	}
+	log.Printf("Backends reloaded: %d added, %d removed, %d total", len(added), len(current), len(pool))
+}
+
+// watchConfig reloads the pool when the modification time or the size of
+// the config file changes.
+func watchConfig(path string, interval time.Duration) {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(modTime) && info.Size() == size {
+			continue
+		}
+		modTime, size = info.ModTime(), info.Size()
+		log.Printf("%s changed, reloading backends", path)
+		reloadPool()
+	}
+}
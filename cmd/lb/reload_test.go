@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadPool(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder(http.MethodGet, "http://server4:8080/health", httpmock.NewStringResponder(http.StatusOK, ""))
+
+	path := writeConfig(t, "lb.yaml", "backends:\n  - url: server1:8080\n  - url: server2:8080\n")
+	*configPath = path
+	defer func() { *configPath = "" }()
+
+	kept := &Server{URL: "server1:8080", ConnCnt: 7, Healthy: true, Weight: 1}
+	removed := &Server{URL: "server2:8080", ConnCnt: 3, Healthy: true, Weight: 1, active: 1}
+	serversPool = []*Server{kept, removed}
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+backends:
+  - url: server1:8080
+    weight: 4
+  - url: server4:8080
+`), 0o600))
+	reloadPool()
+
+	mutex.Lock()
+	require.Len(t, serversPool, 2)
+	assert.Same(t, kept, serversPool[0], "unchanged backends keep their state")
+	assert.Equal(t, 7, kept.ConnCnt)
+	assert.True(t, kept.Healthy)
+	assert.Equal(t, 4, kept.Weight)
+	added := serversPool[1]
+	assert.Equal(t, "server4:8080", added.URL)
+	mutex.Unlock()
+
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return added.Healthy
+	}, time.Second, 10*time.Millisecond, "new backends join after a health check")
+
+	// the removed backend gets no new requests but finishes the current one
+	mutex.Lock()
+	for _, s := range serversPool {
+		assert.NotSame(t, removed, s)
+	}
+	removed.active--
+	mutex.Unlock()
+
+	// invalid configs don't change the pool
+	require.NoError(t, os.WriteFile(path, []byte("backends: []\n"), 0o600))
+	reloadPool()
+	mutex.Lock()
+	assert.Len(t, serversPool, 2)
+	mutex.Unlock()
+
+	for _, s := range serversPool {
+		if s.stop != nil {
+			close(s.stop)
+		}
+	}
+}
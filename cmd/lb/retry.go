@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// maxRetryTokens caps the retry budget, it is also the budget at start.
+const maxRetryTokens = 10
+
+// retryBudget keeps retries to a share of the requests so a failing pool
+// doesn't get a storm of them: every request deposits ratio tokens, every
+// retry takes one.
+type retryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	balance float64
+}
+
+var retryTokens = newRetryBudget(0.2)
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, balance: maxRetryTokens}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.balance += b.ratio
+	if b.balance > maxRetryTokens {
+		b.balance = maxRetryTokens
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// bufferBody reads request bodies up to limit bytes in memory so they can
+// be sent again, it reports whether the request can be replayed. Bigger
+// bodies are streamed once.
+func bufferBody(r *http.Request, limit int64) (bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+	if r.ContentLength > limit {
+		return false, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > limit {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return false, nil
+	}
+	r.Body.Close()
+	r.ContentLength = int64(len(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		if len(buf) == 0 {
+			return http.NoBody, nil
+		}
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// canRetry reports whether the failed request can be sent to another
+// backend: idempotent requests always, the others only if the connection
+// wasn't established, so the backend can't have seen them.
+func canRetry(r *http.Request, err error) bool {
+	if r.Context().Err() != nil {
+		return false // the client is gone
+	}
+	if idempotentMethods[r.Method] {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
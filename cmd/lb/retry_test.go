@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.2)
+	for i := 0; i < maxRetryTokens; i++ {
+		assert.True(t, b.withdraw())
+	}
+	assert.False(t, b.withdraw())
+
+	for i := 0; i < 4; i++ {
+		b.deposit()
+	}
+	assert.False(t, b.withdraw())
+	b.deposit()
+	assert.True(t, b.withdraw())
+
+	for i := 0; i < 1000; i++ {
+		b.deposit()
+	}
+	assert.Equal(t, float64(maxRetryTokens), b.balance)
+}
+
+func TestBufferBody(t *testing.T) {
+	t.Run("No body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		replayable, err := bufferBody(r, 8)
+		assert.NoError(t, err)
+		assert.True(t, replayable)
+	})
+
+	t.Run("Small body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small"))
+		r.ContentLength = -1
+		replayable, err := bufferBody(r, 8)
+		require.NoError(t, err)
+		assert.True(t, replayable)
+		assert.EqualValues(t, 5, r.ContentLength)
+		for i := 0; i < 2; i++ {
+			body, _ := r.GetBody()
+			data, _ := io.ReadAll(body)
+			assert.Equal(t, "small", string(data))
+		}
+	})
+
+	t.Run("Big body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too big for the buffer"))
+		r.ContentLength = -1
+		replayable, err := bufferBody(r, 8)
+		require.NoError(t, err)
+		assert.False(t, replayable)
+		data, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "too big for the buffer", string(data))
+	})
+}
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+func TestCanRetry(t *testing.T) {
+	errReset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	get := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.True(t, canRetry(get, errReset))
+
+	post := httptest.NewRequest(http.MethodPost, "/", nil)
+	assert.True(t, canRetry(post, errRefused))
+	assert.False(t, canRetry(post, errReset))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, canRetry(get.WithContext(ctx), errReset))
+}
+
+func TestForward_Retry(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	errReset := errors.New("connection reset by peer")
+	failWith := errReset
+	httpmock.RegisterResponder("GET", "http://server1:8080/", func(*http.Request) (*http.Response, error) {
+		return nil, failWith
+	})
+	httpmock.RegisterResponder("POST", "http://server1:8080/", func(*http.Request) (*http.Response, error) {
+		return nil, failWith
+	})
+	echo := func(r *http.Request) (*http.Response, error) {
+		data, _ := io.ReadAll(r.Body)
+		return httpmock.NewStringResponse(200, "server2 "+string(data)), nil
+	}
+	httpmock.RegisterResponder("GET", "http://server2:8080/", echo)
+	httpmock.RegisterResponder("POST", "http://server2:8080/", echo)
+
+	send := func(method, body string) (*httptest.ResponseRecorder, error) {
+		serversPool = []*Server{
+			{URL: "server1:8080", Healthy: true},
+			{URL: "server2:8080", Healthy: true},
+		}
+		rr := httptest.NewRecorder()
+		err := forward(rr, httptest.NewRequest(method, "/", strings.NewReader(body)))
+		return rr, err
+	}
+
+	t.Run("Idempotent", func(t *testing.T) {
+		rr, err := send(http.MethodGet, "")
+		assert.NoError(t, err)
+		assert.Equal(t, "server2 ", rr.Body.String())
+		assert.Equal(t, 1, serversPool[0].errors)
+	})
+
+	t.Run("Not idempotent", func(t *testing.T) {
+		rr, err := send(http.MethodPost, "data")
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		assert.Equal(t, 0, serversPool[1].ConnCnt)
+	})
+
+	t.Run("Connection refused", func(t *testing.T) {
+		failWith = errRefused
+		defer func() { failWith = errReset }()
+		rr, err := send(http.MethodPost, "data")
+		assert.NoError(t, err)
+		assert.Equal(t, "server2 data", rr.Body.String())
+	})
+
+	t.Run("No retries", func(t *testing.T) {
+		*maxRetries = 0
+		defer func() { *maxRetries = 2 }()
+		rr, err := send(http.MethodGet, "")
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+
+	t.Run("Budget spent", func(t *testing.T) {
+		saved := retryTokens
+		retryTokens = &retryBudget{ratio: 0.2}
+		defer func() { retryTokens = saved }()
+		rr, err := send(http.MethodGet, "")
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+
+	t.Run("All backends fail", func(t *testing.T) {
+		rr, err := send(http.MethodGet, "")
+		require.NoError(t, err)
+		serversPool[1].Healthy = false
+		rr = httptest.NewRecorder()
+		err = forward(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dimdim28/lab4-software-architecture/httptools"
+)
+
+// draining is set when the balancer starts shutting down, its own health
+// check fails from then on.
+var draining atomic.Bool
+
+// serveHealth answers the health checks of the balancer itself.
+func serveHealth(rw http.ResponseWriter) {
+	if draining.Load() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("draining"))
+		return
+	}
+	_, _ = rw.Write([]byte("ok"))
+}
+
+// shutdown fails the health check of the balancer for delay, so the ones
+// sending it requests notice, then stops the servers waiting up to timeout
+// for the requests in flight.
+func shutdown(delay, timeout time.Duration, servers ...httptools.Server) {
+	draining.Store(true)
+	log.Printf("Draining for %s before shutting down", delay)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("HTTP server shutdown: %s", err)
+		}
+	}
+}
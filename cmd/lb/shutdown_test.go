@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeServer struct {
+	stopped  bool
+	deadline time.Time
+}
+
+func (s *fakeServer) Start() {}
+
+func (s *fakeServer) Shutdown(ctx context.Context) error {
+	s.stopped = true
+	s.deadline, _ = ctx.Deadline()
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	defer draining.Store(false)
+
+	rw := httptest.NewRecorder()
+	serveHealth(rw)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	frontend, admin := &fakeServer{}, &fakeServer{}
+	start := time.Now()
+	shutdown(20*time.Millisecond, time.Minute, frontend, admin)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond, "the balancer drains first")
+	assert.True(t, frontend.stopped)
+	assert.True(t, admin.stopped)
+	assert.WithinDuration(t, start.Add(time.Minute), frontend.deadline, time.Second)
+
+	rw = httptest.NewRecorder()
+	serveHealth(rw)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+}
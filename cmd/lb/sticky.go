@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stickySecretEnv = "LB_STICKY_SECRET"
+
+// affinity pins clients to backends with signed tokens naming the backend,
+// sent back by the clients in a cookie or a header.
+type affinity struct {
+	cookie string
+	header string
+	ttl    time.Duration
+	secret []byte
+	now    func() time.Time
+}
+
+// sessions is nil when session affinity is disabled.
+var sessions *affinity
+
+// newAffinity returns nil if neither the cookie nor the header is set. The
+// tokens are signed with a random secret if there is none, so they don't
+// survive a restart.
+func newAffinity(cookie, header string, ttl time.Duration, secret string) (*affinity, error) {
+	if cookie == "" && header == "" {
+		return nil, nil
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid sticky session TTL %s", ttl)
+	}
+	a := &affinity{cookie: cookie, header: header, ttl: ttl, secret: []byte(secret), now: time.Now}
+	if secret == "" {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, err
+		}
+		log.Printf("No sticky session secret, set -sticky-secret or %s to keep sessions across restarts", stickySecretEnv)
+	}
+	return a, nil
+}
+
+func (a *affinity) signature(backend string, expires int64) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s|%d", backend, expires)
+	return mac.Sum(nil)
+}
+
+// token is base64(backend).expires.base64(signature).
+func (a *affinity) token(backend string) string {
+	expires := a.now().Add(a.ttl).Unix()
+	return base64.RawURLEncoding.EncodeToString([]byte(backend)) + "." +
+		strconv.FormatInt(expires, 10) + "." +
+		base64.RawURLEncoding.EncodeToString(a.signature(backend, expires))
+}
+
+// verify returns the backend of a valid token that hasn't expired.
+func (a *affinity) verify(token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	backend, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || a.now().Unix() >= expires {
+		return "", false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, a.signature(string(backend), expires)) {
+		return "", false
+	}
+	return string(backend), true
+}
+
+// pinned returns the backend the request is pinned to, the header wins
+// over the cookie.
+func (a *affinity) pinned(r *http.Request) string {
+	if a.header != "" {
+		if backend, ok := a.verify(r.Header.Get(a.header)); ok {
+			return backend
+		}
+	}
+	if a.cookie != "" {
+		if c, err := r.Cookie(a.cookie); err == nil {
+			if backend, ok := a.verify(c.Value); ok {
+				return backend
+			}
+		}
+	}
+	return ""
+}
+
+// pin sends the client a new token for the backend.
+func (a *affinity) pin(rw http.ResponseWriter, r *http.Request, backend string) {
+	token := a.token(backend)
+	if a.cookie != "" {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     a.cookie,
+			Value:    token,
+			Path:     "/",
+			MaxAge:   int(a.ttl / time.Second),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	if a.header != "" {
+		rw.Header().Set(a.header, token)
+	}
+}
+
+// pickBackend returns the backend of the pool for the request and whether
+// the client has to be pinned to it, skipping the backends in tried. Pinned
+// clients keep their backend while it is available, the others get one from
+// the strategy. The caller holds mutex.
+func pickBackend(pool []*Server, r *http.Request, tried ...*Server) (*Server, bool) {
+	if sessions != nil {
+		if backend := sessions.pinned(r); backend != "" {
+			for _, s := range pool {
+				if s.URL == backend && usable(s, tried) {
+					return s, false
+				}
+			}
+		}
+	}
+	i := strategy.Pick(pool, r, tried...)
+	if i == -1 {
+		return nil, false
+	}
+	return pool[i], sessions != nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAffinity(t *testing.T) {
+	a, err := newAffinity("", "", time.Hour, "secret")
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+
+	_, err = newAffinity("lb", "", 0, "secret")
+	assert.Error(t, err)
+
+	a, err = newAffinity("lb", "", time.Hour, "")
+	require.NoError(t, err)
+	assert.Len(t, a.secret, 32)
+}
+
+func TestAffinity_Token(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, _ := newAffinity("lb", "", time.Hour, "secret")
+	a.now = func() time.Time { return now }
+
+	token := a.token("server1:8080")
+	backend, ok := a.verify(token)
+	assert.True(t, ok)
+	assert.Equal(t, "server1:8080", backend)
+
+	t.Run("Other secret", func(t *testing.T) {
+		other, _ := newAffinity("lb", "", time.Hour, "other")
+		other.now = a.now
+		_, ok := other.verify(token)
+		assert.False(t, ok)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		forged := a.token("server2:8080")
+		_, ok := a.verify(forged[:len(forged)-43] + token[len(token)-43:])
+		assert.False(t, ok)
+		for _, bad := range []string{"", "x", "a.b.c", token + "."} {
+			_, ok := a.verify(bad)
+			assert.False(t, ok, bad)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		_, ok := a.verify(token)
+		assert.False(t, ok)
+	})
+}
+
+func TestForward_Sticky(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "http://server1:8080/", httpmock.NewStringResponder(200, "server1"))
+	httpmock.RegisterResponder("GET", "http://server2:8080/", httpmock.NewStringResponder(200, "server2"))
+
+	sessions, _ = newAffinity("lb", "X-Lb-Session", time.Hour, "secret")
+	defer func() { sessions = nil }()
+	serversPool = []*Server{
+		{URL: "server1:8080", Healthy: true},
+		{URL: "server2:8080", Healthy: true},
+	}
+
+	send := func(prepare func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		prepare(r)
+		rr := httptest.NewRecorder()
+		require.NoError(t, forward(rr, r))
+		return rr
+	}
+
+	first := send(func(*http.Request) {})
+	assert.Equal(t, "server1", first.Body.String())
+	cookies := first.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "lb", cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, cookies[0].Value, first.Header().Get("X-Lb-Session"))
+
+	t.Run("Cookie", func(t *testing.T) {
+		// least-connections alone would pick server2 now.
+		rr := send(func(r *http.Request) { r.AddCookie(cookies[0]) })
+		assert.Equal(t, "server1", rr.Body.String())
+		assert.Empty(t, rr.Result().Cookies(), "pinned clients keep their token")
+	})
+
+	t.Run("Header", func(t *testing.T) {
+		rr := send(func(r *http.Request) { r.Header.Set("X-Lb-Session", cookies[0].Value) })
+		assert.Equal(t, "server1", rr.Body.String())
+	})
+
+	t.Run("Forged token", func(t *testing.T) {
+		serversPool[0].ConnCnt, serversPool[1].ConnCnt = 0, 10
+		rr := send(func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: "lb", Value: "c2VydmVyMjo4MDgw.9999999999.AAAA"})
+		})
+		assert.Equal(t, "server1", rr.Body.String())
+	})
+
+	t.Run("Re-pin when unhealthy", func(t *testing.T) {
+		serversPool[0].Healthy = false
+		rr := send(func(r *http.Request) { r.AddCookie(cookies[0]) })
+		assert.Equal(t, "server2", rr.Body.String())
+		repinned := rr.Result().Cookies()
+		require.Len(t, repinned, 1)
+		backend, ok := sessions.verify(repinned[0].Value)
+		assert.True(t, ok)
+		assert.Equal(t, "server2:8080", backend)
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Strategy picks the backend for a request. Pick is called with mutex held
+// and returns the index of the backend in pool or -1 if none is available.
+// The backends in tried already got the request and are skipped, the pool
+// is always the whole one.
+type Strategy interface {
+	Pick(pool []*Server, r *http.Request, tried ...*Server) int
+}
+
+// available reports whether the backend can get new requests.
+func available(s *Server) bool {
+	return ready(s) && !inFlight.full(s)
+}
+
+// usable reports whether the backend is available and not one of tried.
+func usable(s *Server, tried []*Server) bool {
+	for _, t := range tried {
+		if s == t {
+			return false
+		}
+	}
+	return available(s)
+}
+
+// ready reports whether the backend is healthy, enabled, not ejected and
+// admitted by its circuit breaker.
+func ready(s *Server) bool {
+	return s.Healthy && s.state == stateEnabled && !outliers.ejected(s) && breakers.admits(s)
+}
+
+var strategies = map[string]func() Strategy{
+	"least-connections":    func() Strategy { return leastConnections{} },
+	"round-robin":          func() Strategy { return &roundRobin{} },
+	"weighted-round-robin": func() Strategy { return &weightedRoundRobin{} },
+	"random":               func() Strategy { return &random{newRand()} },
+	"power-of-two":         func() Strategy { return &powerOfTwo{newRand()} },
+	"least-response-time":  func() Strategy { return leastResponseTime{} },
+}
+
+// newStrategy creates the strategy by its name, hashKey is the request
+// attribute of consistent-hash as accepted by parseHashKey.
+func newStrategy(name, hashKey string) (Strategy, error) {
+	if name == "consistent-hash" {
+		key, err := parseHashKey(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentHash{key: key}, nil
+	}
+	create, ok := strategies[name]
+	if !ok {
+		names := make([]string, 0, len(strategies))
+		for name := range strategies {
+			names = append(names, name)
+		}
+		names = append(names, "consistent-hash")
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown strategy %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return create(), nil
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// leastConnections picks the backend with the fewest requests in flight,
+// see findBestServer.
+type leastConnections struct{}
+
+func (leastConnections) Pick(pool []*Server, _ *http.Request, tried ...*Server) int {
+	return findBestServer(pool, tried...)
+}
+
+// roundRobin picks the available backends in turn.
+type roundRobin struct {
+	next int
+}
+
+func (s *roundRobin) Pick(pool []*Server, _ *http.Request, tried ...*Server) int {
+	for i := range pool {
+		j := (s.next + i) % len(pool)
+		if usable(pool[j], tried) {
+			s.next = j + 1
+			return j
+		}
+	}
+	return -1
+}
+
+// weightedRoundRobin is the smooth weighted round-robin of nginx: every
+// pick adds the weights to the current weights of the backends, takes the
+// biggest one and subtracts the total weight from it, so a backend with
+// weight 3 next to one with weight 1 gets 3 of every 4 requests, spread out.
+type weightedRoundRobin struct {
+	current map[*Server]int
+}
+
+func (s *weightedRoundRobin) Pick(pool []*Server, _ *http.Request, tried ...*Server) int {
+	current := make(map[*Server]int, len(pool)) // drops removed backends
+	best, total := -1, 0
+	for i, server := range pool {
+		if !usable(server, tried) {
+			if available(server) {
+				current[server] = s.current[server] // keeps its turn for the next request
+			}
+			continue
+		}
+		weight := server.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		current[server] = s.current[server] + weight
+		total += weight
+		if best == -1 || current[server] > current[pool[best]] {
+			best = i
+		}
+	}
+	if best != -1 {
+		current[pool[best]] -= total
+	}
+	s.current = current
+	return best
+}
+
+// random picks any available backend.
+type random struct {
+	rand *rand.Rand
+}
+
+func (s *random) Pick(pool []*Server, _ *http.Request, tried ...*Server) int {
+	candidates := usableIndexes(pool, tried)
+	if len(candidates) == 0 {
+		return -1
+	}
+	return candidates[s.rand.Intn(len(candidates))]
+}
+
+// powerOfTwo picks two random backends and takes the one with fewer
+// requests in flight, which avoids the herding of least-connections.
+type powerOfTwo struct {
+	rand *rand.Rand
+}
+
+func (s *powerOfTwo) Pick(pool []*Server, _ *http.Request, tried ...*Server) int {
+	candidates := usableIndexes(pool, tried)
+	switch len(candidates) {
+	case 0:
+		return -1
+	case 1:
+		return candidates[0]
+	}
+	i := s.rand.Intn(len(candidates))
+	j := s.rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if pool[b].active < pool[a].active {
+		return b
+	}
+	return a
+}
+
+// leastResponseTime picks the backend with the lowest average latency.
+// Backends without measurements go first, so every backend gets measured.
+type leastResponseTime struct{}
+
+func (leastResponseTime) Pick(pool []*Server, _ *http.Request, tried ...*Server) int {
+	best := -1
+	for i, s := range pool {
+		if !usable(s, tried) {
+			continue
+		}
+		if best == -1 || s.latency < pool[best].latency ||
+			(s.latency == pool[best].latency && s.active < pool[best].active) {
+			best = i
+		}
+	}
+	return best
+}
+
+func usableIndexes(pool, tried []*Server) []int {
+	var indexes []int
+	for i, s := range pool {
+		if usable(s, tried) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// latencyWeight is the weight of a new measurement in the moving average.
+const latencyWeight = 0.3
+
+// observeLatency updates the exponentially weighted moving average of the
+// time to the response headers, the caller holds mutex.
+func (s *Server) observeLatency(d time.Duration) {
+	if s.latency == 0 {
+		s.latency = d
+		return
+	}
+	s.latency = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(s.latency))
+}
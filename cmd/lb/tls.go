@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/Dimdim28/lab4-software-architecture/httptools"
+)
+
+// backendClient sends the requests and the health checks to the backends.
+var backendClient = http.DefaultClient
+
+// frontendTLS loads the comma separated certificates and keys the balancer
+// terminates TLS with, the one matching the SNI name of a connection is
+// served. It returns nil if there are none.
+func frontendTLS(certs, keys, clientCA string) (*tls.Config, error) {
+	return httptools.LoadServerTLS(splitList(certs), splitList(keys), clientCA)
+}
+
+// newBackendClient returns the client of HTTPS backends trusting the CA,
+// or the system ones if it is empty, and authenticating with the
+// certificate if there is one.
+func newBackendClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	config, err := httptools.LoadClientTLS(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Dimdim28/lab4-software-architecture/httptools"
+	"github.com/Dimdim28/lab4-software-architecture/httptools/tlstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startTLSServer(t *testing.T, config *tls.Config, handler http.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	s := httptools.CreateServer(port, handler, httptools.WithTLS(config))
+	s.Start()
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	addr := fmt.Sprintf("localhost:%d", port)
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	return addr
+}
+
+func TestFrontendTLS(t *testing.T) {
+	config, err := frontendTLS("", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	_, err = frontendTLS("a.pem,b.pem", "a-key.pem", "")
+	assert.Error(t, err)
+}
+
+func TestForward_TLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	backendCert, backendKey := ca.Issue(t, "localhost")
+	lbCert, lbKey := ca.Issue(t, "lb.example")
+	otherCert, otherKey := ca.Issue(t, "other.example")
+
+	// the backend only talks to the balancer
+	backendTLS, err := httptools.LoadServerTLS([]string{backendCert}, []string{backendKey}, ca.File)
+	require.NoError(t, err)
+	backend := startTLSServer(t, backendTLS, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, "hello %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+
+	savedHTTPS, savedClient := *https, backendClient
+	defer func() { *https, backendClient = savedHTTPS, savedClient }()
+	*https = true
+	backendClient, err = newBackendClient(ca.File, lbCert, lbKey)
+	require.NoError(t, err)
+	serversPool = []*Server{{URL: backend, Healthy: true}}
+
+	serverTLS, err := frontendTLS(lbCert+", "+otherCert, lbKey+", "+otherKey, "")
+	require.NoError(t, err)
+	frontend := startTLSServer(t, serverTLS, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		limit(rw, r)
+	}))
+
+	get := func(serverName string) (*http.Response, string) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: ca.Pool, ServerName: serverName},
+		}}
+		resp, err := client.Get("https://" + frontend + "/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	t.Run("SNI", func(t *testing.T) {
+		resp, body := get("lb.example")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello lb.example", body, "the request is encrypted again with the client certificate")
+		assert.Equal(t, []string{"lb.example"}, resp.TLS.PeerCertificates[0].DNSNames)
+
+		resp, _ = get("other.example")
+		assert.Equal(t, []string{"other.example"}, resp.TLS.PeerCertificates[0].DNSNames)
+	})
+
+	t.Run("Untrusted backend", func(t *testing.T) {
+		backendClient, err = newBackendClient("", lbCert, lbKey)
+		require.NoError(t, err)
+		resp, _ := get("lb.example")
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	})
+
+	t.Run("Health check", func(t *testing.T) {
+		backendClient, err = newBackendClient(ca.File, lbCert, lbKey)
+		require.NoError(t, err)
+		assert.NoError(t, probe(backend, "/", newHealthCheck(nil)))
+	})
+}
@@ -2,14 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
-	"io"
+	"log"
 	"net/http"
-	"net/url"
 	"sync"
 	"time"
-	"io/ioutil"
 
+	"github.com/Dimdim28/lab4-software-architecture/dbclient"
 	"github.com/Dimdim28/lab4-software-architecture/httptools"
 	"github.com/Dimdim28/lab4-software-architecture/signal"
 )
@@ -20,7 +21,12 @@ var (
 	healthInit = flag.Bool("health", true, "initial server health")
 	debug      = flag.Bool("debug", false, "whether we can change server's health status")
 	dbUrl      = flag.String("db-url", "db:8100", "hostname of database service")
+	grace      = flag.Duration("shutdown-timeout", 10*time.Second, "how long the requests in flight are waited for on shutdown")
+	tlsCert    = flag.String("tls-cert", "", "certificate file to serve HTTPS with, HTTP is served without it")
+	tlsKey     = flag.String("tls-key", "", "key file of -tls-cert")
+	clientCA   = flag.String("tls-client-ca", "", "CA file the client certificates have to be signed by, mutual TLS is off without it")
 	report		 = make(Report)
+	dbClient   *dbclient.Client
 )
 
 const (
@@ -47,6 +53,7 @@ func (c *boolMutex) Get() bool {
 
 func main() {
 	flag.Parse()
+	dbClient = dbclient.New(scheme + "://" + *dbUrl)
 	h := new(http.ServeMux)
 	health := boolMutex{v: *healthInit}
 	createTeam()
@@ -59,9 +66,23 @@ func main() {
 	h.Handle("/api/v1/some-data", http.HandlerFunc(handleDefaultGet))
 	h.Handle("/report", report)
 
-	server := httptools.CreateServer(*port, h)
+	var opts []httptools.Option
+	if *tlsCert != "" || *tlsKey != "" {
+		config, err := httptools.LoadServerTLS([]string{*tlsCert}, []string{*tlsKey}, *clientCA)
+		if err != nil {
+			log.Fatalf("Invalid TLS config: %s", err)
+		}
+		opts = append(opts, httptools.WithTLS(config))
+	}
+	server := httptools.CreateServer(*port, h, opts...)
 	server.Start()
 	signal.WaitForTerminationSignal()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown: %s", err)
+	}
 }
 
 func healthHandler(health *boolMutex) http.Handler {
@@ -95,48 +116,34 @@ func handleDefaultGet(rw http.ResponseWriter, r *http.Request) {
 }
 
 func performDbRequest(ctx context.Context, rw http.ResponseWriter, r *http.Request, key string) {
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = *dbUrl
-	fwdRequest.Host = *dbUrl
-	fwdRequest.URL.Scheme = "http"
-	fwdRequest.URL.Path = "/db/" + key
-
-	resp, err := http.DefaultClient.Do(fwdRequest)
+	value, err := dbClient.Get(ctx, key)
 	if *delay > 0 && *delay < 300 {
 		time.Sleep(time.Duration(*delay) * time.Millisecond)
 	}
+	if errors.Is(err, dbclient.ErrNotFound) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if resp.StatusCode == http.StatusBadRequest {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err == nil && string(body) == "record does not exist\n" {
-			rw.WriteHeader(http.StatusNotFound)
-			return
-		}
-	}
-	
 	report.Process(r)
-	copyResponseDetails(rw, resp)
-}
-
-func copyResponseDetails(rw http.ResponseWriter, resp *http.Response) {
-	rw.WriteHeader(resp.StatusCode)
-	rw.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	rw.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
-	io.Copy(rw, resp.Body)
-	resp.Body.Close()
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}{key, value})
 }
 
 func createTeam() {
-	formData := url.Values{}
-	formData.Set("value", time.Now().Format("2006-01-02"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	resp, err := http.PostForm(scheme + "://" + *dbUrl + "/db/" + teamName, formData)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	err := dbClient.Put(ctx, teamName, time.Now().Format("2006-01-02"))
+	if err != nil {
 		panic("Error occured when initializing DB")
 	}
-}
\ No newline at end of file
+}
@@ -6,16 +6,19 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
-)
 
-var https = flag.Bool("https", false, "whether backends support HTTPs")
+	"github.com/Dimdim28/lab4-software-architecture/httptools"
+)
 
-var serversPool = []string{
-	"localhost:8080",
-	"localhost:8081",
-	"localhost:8082",
-}
+var (
+	https   = flag.Bool("https", false, "whether backends support HTTPs")
+	ca      = flag.String("ca", "", "CA file the server certificates are verified with, the system CAs if empty")
+	cert    = flag.String("cert", "", "client certificate file presented to the servers")
+	key     = flag.String("key", "", "key file of -cert")
+	servers = flag.String("servers", "localhost:8080,localhost:8081,localhost:8082", "comma separated host:port list of servers")
+)
 
 type report map[string][]string
 
@@ -28,9 +31,22 @@ func scheme() string {
 
 func main()  {
 	flag.Parse()
+	var serversPool []string
+	for _, s := range strings.Split(*servers, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			serversPool = append(serversPool, s)
+		}
+	}
 
 	client := new(http.Client)
 	client.Timeout = 10 * time.Second
+	if *https {
+		config, err := httptools.LoadClientTLS(*ca, *cert, *key)
+		if err != nil {
+			log.Fatalf("Invalid TLS config: %s", err)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: config}
+	}
 
 	res := make([]report, len(serversPool))
 	for i, s := range serversPool {
@@ -3,48 +3,68 @@ package datastore
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 )
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 
-type hashIndex map[string]int64
-
 type block struct {
-	index     hashIndex
+	index     *memtable
+	sparse    *sparseIndex // replaces index once a sealed block is moved to disk
+	sorted    *blockIndex  // replaces index for segments written by compaction
 	segment   *os.File
 	outPath   string
 	outOffset int64
 	rwmu      sync.RWMutex
-	writeCh chan writeArgument
+	writeCh   chan writeArgument
 	cancel    context.CancelFunc
 }
 
 func newBlock(dir, outFileName string) (*block, error) {
+	return openBlock(dir, outFileName, false)
+}
+
+// openBlock opens the segment and restores its index. A read-only block
+// has no writer goroutine and its segment is never created.
+func openBlock(dir, outFileName string, readOnly bool) (*block, error) {
 	outputPath := filepath.Join(dir, outFileName)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	flag := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(outputPath, flag, 0o600)
 	if err != nil {
 		return nil, err
 	}
 
 	bl := &block{
-		index:    make(hashIndex),
-		segment:  f,
+		index:   newMemtable(),
+		segment: f,
 		outPath: outputPath,
-		writeCh: make(chan writeArgument),
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	bl.cancel = cancel
-	go bl.write(ctx)
+	if !readOnly {
+		bl.writeCh = make(chan writeArgument)
+		ctx, cancel := context.WithCancel(context.Background())
+		bl.cancel = cancel
+		go bl.write(ctx)
+	}
 
 	err = bl.recover()
+	if readOnly && err == io.ErrUnexpectedEOF {
+		// the writer is still appending the last record, the index stops
+		// before it
+		err = io.EOF
+	}
 	if err != nil && err != io.EOF {
+		bl.close()
 		return nil, err
 	}
 
@@ -53,6 +73,8 @@ func newBlock(dir, outFileName string) (*block, error) {
 
 const bufSize = 8192
 
+// recover rebuilds the memtable reading only the keys of the records,
+// values are skipped, so big records are never loaded into memory.
 func (b *block) recover() error {
 	input, err := os.Open(b.outPath)
 	if err != nil {
@@ -60,124 +82,256 @@ func (b *block) recover() error {
 	}
 	defer input.Close()
 
-	buf := make([]byte, bufSize)
 	in := bufio.NewReaderSize(input, bufSize)
-
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
+	for {
+		key, size, err := readRecordKey(in)
+		if err != nil {
 			return err
 		}
+		b.index.set(key, b.outOffset)
+		b.outOffset += size
+	}
+}
 
-		size := binary.LittleEndian.Uint32(header)
-
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
-		}
+// close stops the writer and closes the segment, flushing it to the disk
+// if it was written.
+func (b *block) close() error {
+	var err error
+	if b.cancel != nil {
+		b.cancel()
+		close(b.writeCh)
+		err = b.segment.Sync()
+	}
+	if closeErr := b.segment.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-		n, err = in.Read(data)
+// openSealedBlock opens a segment that will not be written anymore. Sorted
+// segments are served from their block index, others from a sparse index
+// file when step is set, or from a memtable otherwise.
+func openSealedBlock(dir, outFileName string, step int, readOnly bool) (*block, error) {
+	outputPath := filepath.Join(dir, outFileName)
+	sorted, err := scanSortedSegment(outputPath)
+	if err == nil {
+		return openSortedBlock(outputPath, sorted)
+	}
+	if err != errNotSorted {
+		return nil, err
+	}
+	if step == 0 {
+		return openBlock(dir, outFileName, readOnly)
+	}
 
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
-			}
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return nil, err
+	}
 
-			var e entry
-			e.Decode(data)
-			b.index[e.key] = b.outOffset
-			b.outOffset += int64(n)
+	sparse, err := loadSparseIndex(outputPath+indexSuffix, info.Size(), step)
+	if err == nil {
+		f, err := os.Open(outputPath)
+		if err != nil {
+			return nil, err
 		}
+		return &block{
+			sparse:    sparse,
+			segment:   f,
+			outPath:   outputPath,
+			outOffset: info.Size(),
+		}, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Printf("Rebuilding index of %s: %s", outFileName, err)
 	}
 
-	return err
+	b, err := openBlock(dir, outFileName, readOnly)
+	if err != nil || readOnly {
+		return b, err
+	}
+	err = b.seal(step)
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	return b, nil
 }
 
-func (b *block) close() error {
-	b.cancel()
-	close(b.writeCh)
-	return b.segment.Close()
+// seal moves the index of the block to a sparse index file on disk.
+func (b *block) seal(step int) error {
+	b.rwmu.Lock()
+	defer b.rwmu.Unlock()
+
+	if b.index == nil {
+		return nil
+	}
+	sparse, err := writeSparseIndex(b.outPath+indexSuffix, b.outOffset, b.index, step)
+	if err != nil {
+		return err
+	}
+	b.sparse = sparse
+	b.index = nil
+	return nil
 }
 
-func (b *block) get(key string) (string, string, error) {
+func openSortedBlock(path string, sorted *blockIndex) (*block, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &block{
+		sorted:    sorted,
+		segment:   f,
+		outPath:   path,
+		outOffset: sorted.size,
+	}, nil
+}
+
+func (b *block) lookup(key string) (int64, bool, error) {
 	b.rwmu.RLock()
-	b.rwmu.RUnlock()
+	defer b.rwmu.RUnlock()
+
+	switch {
+	case b.sorted != nil:
+		return b.sorted.get(b.outPath, key)
+	case b.sparse != nil:
+		return b.sparse.get(key)
+	}
+	position, ok := b.index.get(key)
+	return position, ok, nil
+}
 
-	position, ok := b.index[key]
+// iterate walks the keys of the block starting from start in ascending order.
+func (b *block) iterate(start string) (keyIterator, error) {
+	b.rwmu.Lock()
+	defer b.rwmu.Unlock()
 
-	if !ok {
-		return "", "", ErrNotFound
+	switch {
+	case b.sorted != nil:
+		return b.sorted.iterate(b.outPath, start)
+	case b.sparse != nil:
+		return b.sparse.iterate(start)
 	}
 
-	file, err := os.Open(b.outPath)
-	if err != nil {
-		return "", "", err
+	// copy the memtable, so puts don't have to wait for the walk
+	keys := b.index.sortedKeys()
+	keys = keys[sort.SearchStrings(keys, start):]
+	entries := make([]indexEntry, len(keys))
+	for i, key := range keys {
+		entries[i] = indexEntry{key, b.index.offsets[key]}
 	}
-	defer file.Close()
+	return &sliceIterator{entries}, nil
+}
 
-	_, err = file.Seek(position, 0)
+// open returns the segment file positioned records are read from and the
+// position of the newest record of key. The caller has to close the file.
+func (b *block) open(key string) (*os.File, int64, error) {
+	position, ok, err := b.lookup(key)
 	if err != nil {
-		return "", "", err
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, ErrNotFound
 	}
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+	file, err := os.Open(b.outPath)
 	if err != nil {
-		return "", "", err
+		return nil, 0, err
 	}
+	return file, position, nil
+}
 
-	_, err = file.Seek(position, 0)
+func (b *block) get(key string) (entry, error) {
+	file, position, err := b.open(key)
 	if err != nil {
-		return "", "", err
+		return entry{}, err
 	}
-	vType, err := readType(reader)
+	defer file.Close()
+	return readRecord(file, position)
+}
+
+// head returns the newest record of key without reading its value.
+func (b *block) head(key string) (recordHeader, error) {
+	file, position, err := b.open(key)
 	if err != nil {
-		return "", "", err
+		return recordHeader{}, err
 	}
-	return value, vType, nil
+	defer file.Close()
+	return readRecordHeader(file, position)
 }
 
 func (b *block) put(key, vType, value string) error {
-
-	e := entry{
+	return b.putEntry(entry{
 		key:   key,
 		vType: vType,
 		value: value,
+	})
+}
+
+func (b *block) putEntry(e entry) error {
+	return b.writeRecord(e.key, writeArgument{data: e.Encode()})
+}
+
+// putStream writes the record with size bytes of the value read from body.
+func (b *block) putStream(key, vType string, body io.Reader, size int64) error {
+	return b.writeRecord(key, writeArgument{
+		data:     encodeHeader(key, vType, size, 0),
+		body:     body,
+		bodySize: size,
+	})
+}
+
+func (b *block) writeRecord(key string, arg writeArgument) error {
+	if b.writeCh == nil {
+		return ErrReadOnly
 	}
 
 	resultCh := make(chan writeResult)
-	b.writeCh <- writeArgument{resultCh, e.Encode()}
+	arg.resultCh = resultCh
+	b.writeCh <- arg
 	result := <-resultCh
 	close(resultCh)
 
 	if result.err == nil {
 		b.rwmu.Lock()
-		b.index[key] = b.outOffset
-		b.outOffset += int64(result.n)
+		b.index.set(key, b.outOffset)
+		b.outOffset += result.n
 		b.rwmu.Unlock()
 	}
 
 	return result.err
 }
 
+// getStream returns a reader of the value stored under key and the record it belongs to.
+func (b *block) getStream(key string) (io.ReadCloser, recordHeader, error) {
+	file, position, err := b.open(key)
+	if err != nil {
+		return nil, recordHeader{}, err
+	}
+	h, err := readRecordHeader(file, position)
+	if err != nil {
+		file.Close()
+		return nil, recordHeader{}, err
+	}
+
+	value := io.NewSectionReader(file, position+h.headerSize, h.valueSize)
+	return struct {
+		io.Reader
+		io.Closer
+	}{value, file}, h, nil
+}
+
 type writeResult struct {
-	n   int
+	n   int64
 	err error
 }
 
 type writeArgument struct {
 	resultCh chan writeResult
 	data     []byte
+	body     io.Reader // written right after data when set
+	bodySize int64
 }
 
 func (b *block) write(ctx context.Context) {
@@ -186,12 +340,36 @@ func (b *block) write(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case arg := <-b.writeCh:
-			n, err := b.segment.Write(arg.data)
-			arg.resultCh <- writeResult{n, err}
+			arg.resultCh <- b.appendRecord(arg)
 		}
 	}
 }
 
+func (b *block) appendRecord(arg writeArgument) writeResult {
+	start, err := b.segment.Seek(0, io.SeekEnd)
+	if err != nil {
+		return writeResult{0, err}
+	}
+
+	n, err := b.segment.Write(arg.data)
+	written := int64(n)
+	if err == nil && arg.body != nil {
+		var copied int64
+		copied, err = io.CopyN(b.segment, arg.body, arg.bodySize)
+		written += copied
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		if written > 0 { // don't leave a partial record behind
+			b.segment.Truncate(start)
+		}
+		return writeResult{0, err}
+	}
+	return writeResult{written, nil}
+}
+
 func (b *block) size() (int64, error) {
 	info, err := os.Stat(b.outPath)
 	if err != nil {
@@ -202,45 +380,72 @@ func (b *block) size() (int64, error) {
 	return currentSize, nil
 }
 
-func mergeAll(blocks []*block) (*block, error) {
+// segmentFiles keeps the segments of blocks open while they are walked.
+type segmentFiles map[*block]*os.File
+
+func (files segmentFiles) head(b *block, offset int64) (recordHeader, error) {
+	f, ok := files[b]
+	if !ok {
+		var err error
+		f, err = os.Open(b.outPath)
+		if err != nil {
+			return recordHeader{}, err
+		}
+		files[b] = f
+	}
+	return readRecordHeader(f, offset)
+}
+
+func (files segmentFiles) close() {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// compact writes the newest record of every key of blocks to a new segment
+// at path in key order, copying records without decoding their values.
+// Removed keys and values expired by now are dropped.
+func compact(blocks []*block, path string, now time.Time) (*block, error) {
 	if len(blocks) == 0 {
 		return nil, fmt.Errorf("empty array of blocks")
 	}
 
-	newBlock, err := newBlock(blocks[0].outPath+"-temp", "")
+	sources := make(segmentFiles, len(blocks))
+	defer sources.close()
+
+	w, err := createSortedSegment(path)
 	if err != nil {
 		return nil, err
 	}
-
-	for j := len(blocks) - 1; j >= 0; j-- {
-		err = mergeTwoBlocks(newBlock, blocks[j])
-		if err != nil {
-			return nil, err
+	err = mergeBlocks(blocks, "", "", func(key string, b *block, offset int64) error {
+		h, err := sources.head(b, offset)
+		if err != nil || !h.live(now) {
+			return err
 		}
+		return w.copyRecord(key, sources[b], offset)
+	})
+	if err == nil {
+		err = w.finish()
+	} else {
+		w.finish()
 	}
-
-	return newBlock, nil
-}
-
-func mergeTwoBlocks(destBlock, srcBlock *block) error {
-	for key := range srcBlock.index {
-		_, ok := destBlock.index[key]
-		if !ok {
-			val, vType, err := srcBlock.get(key)
-			if err != nil {
-				return err
-			}
-			destBlock.put(key, vType, val)
-		}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
 	}
-	return nil
+
+	return openSortedBlock(path, w.index)
 }
 
 func (b *block) delete() error {
-	err := os.Remove(b.segment.Name())
+	err := os.Remove(b.outPath)
 	if err != nil {
 		return err
 	}
 
+	err = os.Remove(b.outPath + indexSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
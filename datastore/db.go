@@ -2,15 +2,39 @@ package datastore
 
 import (
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const outFileName = "segment-"
 const outFileSize int64 = 10000000
+const lockFileName = "LOCK"
+const tempSuffix = "-temp"
+
+// records store sizes as uint32, so the limits must keep a record below 4 GiB
+const defaultMaxKeySize = 1 << 16
+const defaultMaxValueSize int64 = 1 << 30
+
+var (
+	ErrLocked        = fmt.Errorf("database directory is locked by another process")
+	ErrReadOnly      = fmt.Errorf("database is opened in read-only mode")
+	ErrKeyTooLarge   = fmt.Errorf("key is too large")
+	ErrValueTooLarge = fmt.Errorf("value is too large")
+	ErrWrongType     = fmt.Errorf("value has a different type")
+	ErrOverflow      = fmt.Errorf("increment or decrement would overflow")
+)
+
+// errStopScan stops a Scan when its callback asks for no more keys.
+var errStopScan = fmt.Errorf("scan stopped")
 
 // db
 type Db struct {
@@ -21,38 +45,122 @@ type Db struct {
 	segmentName   string
 	segmentNumber int
 	segmentSize   int64
+
+	readOnly bool
+	lock     *os.File
+	mu       sync.RWMutex
+
+	// every indexStep-th key of unsorted sealed segments is kept in memory, 0 keeps all of them
+	indexStep int
+
+	maxKeySize   int
+	maxValueSize int64
+
+	// now tells the time values expire at, tests replace it
+	now func() time.Time
+
+	merges int64
+}
+
+// Stats describes the segments of the database.
+type Stats struct {
+	Segments int
+	Size     int64 // bytes in all segments
+	Merges   int64 // merges since the database was opened
 }
 
-func NewDb(dir string) (*Db, error) {
+// Option configures the Db created by NewDb.
+type Option func(*Db)
+
+// ReadOnly opens the directory without taking the lock. Writes fail with
+// ErrReadOnly and the data is a snapshot of the segments at open time.
+func ReadOnly() Option {
+	return func(db *Db) {
+		db.readOnly = true
+	}
+}
+
+// SparseIndex moves the index of sealed segments to sorted files on disk and
+// keeps only every step-th key in memory. Lookups in sealed segments read
+// one run of up to step index entries, so a bigger step uses less memory
+// but makes lookups slower. The active segment is always indexed in memory.
+// The step only applies to sealed segments that are not merged yet, merged
+// segments are sorted by key and keep one key per data block in memory.
+func SparseIndex(step int) Option {
+	return func(db *Db) {
+		if step <= 0 {
+			step = defaultIndexStep
+		}
+		db.indexStep = step
+	}
+}
+
+// MaxKeySize limits the size of keys in bytes, larger keys are rejected with ErrKeyTooLarge.
+func MaxKeySize(size int) Option {
+	return func(db *Db) {
+		if size > 0 && size <= defaultMaxKeySize {
+			db.maxKeySize = size
+		}
+	}
+}
+
+// MaxValueSize limits the size of values in bytes, larger values are rejected with ErrValueTooLarge.
+func MaxValueSize(size int64) Option {
+	return func(db *Db) {
+		if size > 0 && size <= defaultMaxValueSize {
+			db.maxValueSize = size
+		}
+	}
+}
+
+func NewDb(dir string, opts ...Option) (*Db, error) {
 	db := &Db{
-		dir:         dir,
-		segmentName: outFileName,
-		segmentSize: outFileSize,
+		dir:          dir,
+		segmentName:  outFileName,
+		segmentSize:  outFileSize,
+		maxKeySize:   defaultMaxKeySize,
+		maxValueSize: defaultMaxValueSize,
+		now:          time.Now,
+	}
+	for _, opt := range opts {
+		opt(db)
 	}
 
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		os.MkdirAll(dir, os.ModePerm)
+	if !db.readOnly {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			os.MkdirAll(dir, os.ModePerm)
+		}
+
+		lock, err := lockDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		db.lock = lock
 	}
 
 	f, err := os.Open(dir)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 	defer f.Close()
 
 	filesNames, err := f.Readdirnames(0)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	if len(filesNames) != 0 { // call recovery, if directory is no empty
-		err := db.recover(filesNames)
-		if err != nil {
-			return nil, err
-		}
-	} else { // create the first block, if directory is empty
+	err = db.recover(filesNames)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if len(db.blocks) == 0 && !db.readOnly { // create the first block, if directory is empty
 		err = db.addNewBlockToDB()
 		if err != nil {
+			db.Close()
 			return nil, err
 		}
 	}
@@ -71,39 +179,141 @@ func (db *Db) addNewBlockToDB() error {
 	return nil
 }
 
-func (db *Db) recover(filesNames []string) error { // sort by growth
-	sort.Strings(filesNames)
-	// regexp for checking file names
-	r, _ := regexp.Compile(db.segmentName + "[0-9]+")
-	for _, fileName := range filesNames {
-		match := r.MatchString(fileName)
+func (db *Db) recover(filesNames []string) error {
+	prefix := "^" + regexp.QuoteMeta(db.segmentName)
+	segmentRe := regexp.MustCompile(prefix + "([0-9]+)$")
+	indexRe := regexp.MustCompile(prefix + "[0-9]+" + regexp.QuoteMeta(indexSuffix) + "$")
+	tempRe := regexp.MustCompile(prefix + ".+" + tempSuffix + "$")
 
-		if match {
-			b, err := newBlock(db.dir, fileName)
+	type segment struct {
+		name   string
+		number int
+	}
+	var segments []segment
+	var indexes []string
+	for _, fileName := range filesNames {
+		if fileName == lockFileName {
+			continue
+		}
+		if m := segmentRe.FindStringSubmatch(fileName); m != nil {
+			n, err := strconv.Atoi(m[1])
 			if err != nil {
 				return err
 			}
-			db.blocks = append(db.blocks, b)
-			reg, _ := regexp.Compile("[0-9]+")
-			db.segmentNumber, err = strconv.Atoi(reg.FindString(fileName))
+			segments = append(segments, segment{fileName, n})
+		} else if indexRe.MatchString(fileName) {
+			indexes = append(indexes, fileName)
+		} else if tempRe.MatchString(fileName) {
+			// merge replaces segment-0 before deleting its sources and uploads
+			// are copied to a segment before they are acknowledged, so a
+			// leftover temp file never holds the only copy of the data
+			if db.readOnly {
+				continue
+			}
+			log.Printf("Removing incomplete temporary file %s", fileName)
+			err := os.Remove(filepath.Join(db.dir, fileName))
 			if err != nil {
 				return err
 			}
 		} else {
-			return fmt.Errorf("wrongly named file in the working directory: %v. Current file neme pattern: %v + int number", fileName, db.segmentName)
+			log.Printf("Ignoring unknown file in the database directory: %s", fileName)
+		}
+	}
+
+	// sort by segment number, so segment-10 goes after segment-2
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].number < segments[j].number
+	})
+	for i, s := range segments {
+		var b *block
+		var err error
+		if i < len(segments)-1 {
+			b, err = openSealedBlock(db.dir, s.name, db.indexStep, db.readOnly)
+		} else {
+			b, err = openBlock(db.dir, s.name, db.readOnly)
+		}
+		if err != nil {
+			return err
+		}
+		db.blocks = append(db.blocks, b)
+		db.segmentNumber = s.number
+	}
+
+	if !db.readOnly { // remove indexes of segments deleted by a merge
+		for _, fileName := range indexes {
+			segmentPath := filepath.Join(db.dir, strings.TrimSuffix(fileName, indexSuffix))
+			if _, err := os.Stat(segmentPath); os.IsNotExist(err) {
+				os.Remove(filepath.Join(db.dir, fileName))
+			}
 		}
 	}
 	return nil
 }
 
 func (db *Db) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var err error
 	for _, block := range db.blocks {
-		block.close()
+		if closeErr := block.close(); err == nil {
+			err = closeErr
+		}
 	}
-	return nil
+	db.blocks = nil
+	if db.lock != nil {
+		if unlockErr := unlockDir(db.lock); err == nil {
+			err = unlockErr
+		}
+		db.lock = nil
+	}
+	return err
 }
 
 func (db *Db) putType(key, vType, value string) error {
+	err := db.checkSize(key, int64(len(value)))
+	if err != nil {
+		return err
+	}
+	return db.putRecord(func(b *block) error {
+		return b.put(key, vType, value)
+	})
+}
+
+// writeEntry is putType for callers that already hold db.mu.
+func (db *Db) writeEntry(e entry) error {
+	err := db.checkSize(e.key, int64(len(e.value)))
+	if err != nil {
+		return err
+	}
+	return db.appendRecord(func(b *block) error {
+		return b.putEntry(e)
+	})
+}
+
+func (db *Db) checkSize(key string, valueSize int64) error {
+	if len(key) > db.maxKeySize {
+		return ErrKeyTooLarge
+	}
+	if valueSize > db.maxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// putRecord writes a record to the last block with put, starting a new
+// block and merging the old ones when the last block is full.
+func (db *Db) putRecord(put func(b *block) error) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.appendRecord(put)
+}
+
+// appendRecord is putRecord for callers that already hold db.mu.
+func (db *Db) appendRecord(put func(b *block) error) error {
 	lastBlock := db.blocks[len(db.blocks)-1]
 	curSize, err := lastBlock.size()
 	if err != nil {
@@ -111,11 +321,7 @@ func (db *Db) putType(key, vType, value string) error {
 	}
 
 	if curSize <= db.segmentSize {
-		err := lastBlock.put(key, vType, value)
-		if err != nil {
-			return err
-		}
-		return nil
+		return put(lastBlock)
 	}
 
 	err = db.addNewBlockToDB() // if no place to write, we create new block
@@ -123,7 +329,7 @@ func (db *Db) putType(key, vType, value string) error {
 		return err
 	}
 
-	err = db.blocks[len(db.blocks)-1].put(key, vType, value)
+	err = put(db.blocks[len(db.blocks)-1])
 	if err != nil {
 		return err
 	}
@@ -133,23 +339,215 @@ func (db *Db) putType(key, vType, value string) error {
 		if err != nil {
 			return err
 		}
+	} else if db.indexStep > 0 { // the sealed block is not merged yet
+		err = lastBlock.seal(db.indexStep)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (db *Db) getType(key string) (string, string, error) {
-	var val, vType string
-	var err error
+// PutStream stores a string value of size bytes read from r, size may be -1
+// if it is unknown. The value is first spooled to a temporary file, so it
+// is never held in memory and a slow reader doesn't hold the lock. The
+// spooled value is then copied to the segment under the lock, so other
+// requests wait for that local copy of at most MaxValueSize bytes.
+func (db *Db) PutStream(key string, r io.Reader, size int64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	err := db.checkSize(key, size)
+	if err != nil {
+		return err
+	}
+
+	spool, err := os.CreateTemp(db.dir, db.segmentName+"upload-*"+tempSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	n, err := io.Copy(spool, io.LimitReader(r, db.maxValueSize+1))
+	if err != nil {
+		return err
+	}
+	if n > db.maxValueSize {
+		return ErrValueTooLarge
+	}
+	if size >= 0 && n != size {
+		return io.ErrUnexpectedEOF
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return db.putRecord(func(b *block) error {
+		return b.putStream(key, "string", spool, n)
+	})
+}
+
+// GetStream returns a reader of the string value stored under key and the
+// size of the value in bytes. The caller has to close the reader.
+func (db *Db) GetStream(key string) (io.ReadCloser, int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for j := len(db.blocks) - 1; j >= 0; j-- {
+		value, h, err := db.blocks[j].getStream(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if !h.live(db.now()) {
+			value.Close()
+			return nil, 0, ErrNotFound
+		}
+		if h.vType != "string" {
+			value.Close()
+			return nil, 0, ErrWrongType
+		}
+		return value, h.valueSize, nil
+	}
+	return nil, 0, ErrNotFound
+}
+
+// find returns the newest record of key, the caller has to hold db.mu.
+func (db *Db) find(key string) (entry, error) {
 	for j := len(db.blocks) - 1; j >= 0; j-- {
-		val, vType, err = db.blocks[j].get(key)
-		if err != nil && err != ErrNotFound {
-			return "", "", err
+		e, err := db.blocks[j].get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return entry{}, err
 		}
-		if val != "" {
-			return val, vType, nil
+		if !e.header().live(db.now()) {
+			return entry{}, ErrNotFound
 		}
+		return e, nil
 	}
-	return "", "", ErrNotFound
+	return entry{}, ErrNotFound
+}
+
+// findHeader is find without reading the value.
+func (db *Db) findHeader(key string) (recordHeader, error) {
+	for j := len(db.blocks) - 1; j >= 0; j-- {
+		h, err := db.blocks[j].head(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return recordHeader{}, err
+		}
+		if !h.live(db.now()) {
+			return recordHeader{}, ErrNotFound
+		}
+		return h, nil
+	}
+	return recordHeader{}, ErrNotFound
+}
+
+func (db *Db) getType(key string) (string, string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	e, err := db.find(key)
+	if err != nil {
+		return "", "", err
+	}
+	return e.value, e.vType, nil
+}
+
+// Exists reports whether a value of any type is stored under key.
+func (db *Db) Exists(key string) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, err := db.findHeader(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes the value stored under key and reports whether there was one.
+func (db *Db) Delete(key string) (bool, error) {
+	if db.readOnly {
+		return false, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, err := db.findHeader(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, db.writeEntry(entry{key: key, vType: tombstoneType})
+}
+
+// Expire makes the value stored under key expire after ttl, a ttl that is
+// not positive removes it right away. It reports whether there was a value.
+func (db *Db) Expire(key string, ttl time.Duration) (bool, error) {
+	if db.readOnly {
+		return false, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e, err := db.find(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ttl <= 0 {
+		e = entry{key: key, vType: tombstoneType}
+	} else {
+		e.expiresAt = db.now().Add(ttl).UnixNano()
+	}
+	return true, db.writeEntry(e)
+}
+
+// IncrBy adds delta to the integer stored under key and returns the result,
+// which is stored as int64. A missing key counts as 0 and a string value is
+// accepted if it holds a decimal integer. The expiration of the key is kept.
+func (db *Db) IncrBy(key string, delta int64) (int64, error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	e, err := db.find(key)
+	var n int64
+	switch {
+	case err == ErrNotFound:
+		e = entry{key: key}
+	case err != nil:
+		return 0, err
+	default:
+		n, err = strconv.ParseInt(e.value, 10, 64)
+		if err != nil {
+			return 0, ErrWrongType
+		}
+	}
+
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	n += delta
+	e.vType = "int64"
+	e.value = strconv.FormatInt(n, 10)
+	return n, db.writeEntry(e)
 }
 
 func (db *Db) Put(key, value string) error {
@@ -166,7 +564,7 @@ func (db *Db) Get(key string) (string, error) {
 		return "", err
 	}
 	if vType != "string" {
-		return "", fmt.Errorf("ERROR! Wrong type of value")
+		return "", ErrWrongType
 	}
 	return val, nil
 }
@@ -185,7 +583,7 @@ func (db *Db) GetInt64(key string) (int64, error) {
 		return 0, err
 	}
 	if vType != "int64" {
-		return 0, fmt.Errorf("ERROR! Wrong type of value")
+		return 0, ErrWrongType
 	}
 	n, err := strconv.ParseInt(val, 10, 64)
 	if err != nil {
@@ -194,27 +592,94 @@ func (db *Db) GetInt64(key string) (int64, error) {
 	return n, nil
 }
 
+// Range returns the keys in [start, end) in ascending order.
+// An empty end means the range has no upper bound.
+func (db *Db) Range(start, end string) ([]string, error) {
+	var keys []string
+	err := db.Scan(start, func(key string) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Scan calls fn with every key starting from start in ascending order
+// until fn returns false. Writes wait until the scan is over.
+func (db *Db) Scan(start string, fn func(key string) bool) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	files := make(segmentFiles)
+	defer files.close()
+	now := db.now()
+	err := mergeBlocks(db.blocks, start, "", func(key string, b *block, offset int64) error {
+		h, err := files.head(b, offset)
+		if err != nil || !h.live(now) {
+			return err
+		}
+		if !fn(key) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
+
+func (db *Db) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := Stats{Segments: len(db.blocks), Merges: db.merges}
+	for _, b := range db.blocks {
+		b.rwmu.RLock()
+		stats.Size += b.outOffset
+		b.rwmu.RUnlock()
+	}
+	return stats
+}
+
 func (db *Db) merge() error {
-	tempBlock, err := mergeAll(db.blocks[:len(db.blocks)-1])
+	sealed := db.blocks[:len(db.blocks)-1]
+	tempPath := filepath.Join(db.dir, db.segmentName+"0"+tempSuffix)
+	merged, err := compact(sealed, tempPath, db.now())
 	if err != nil {
 		return err
 	}
 
-	db.blocks = append(db.blocks[:1], db.blocks[:]...) // add a block to the array
-	db.blocks[0] = tempBlock
+	// the merged segment replaces segment-0 first, so a crash before the
+	// sources are removed only leaves redundant segments behind
+	mergedPath := filepath.Join(db.dir, db.segmentName+"0")
+	err = os.Remove(mergedPath + indexSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(tempPath, mergedPath)
+	if err != nil {
+		return err
+	}
+	merged.outPath = mergedPath
 
-	for _, block := range db.blocks[1 : len(db.blocks)-1] { // remove already unnecessary blocks
+	for _, block := range sealed { // remove already unnecessary blocks
+		block.close()
+		if block.outPath == mergedPath {
+			continue
+		}
 		err := block.delete()
 		if err != nil {
 			return err
 		}
 	}
 
-	db.blocks = append(db.blocks[:1], db.blocks[len(db.blocks)-1]) // remove the rest from array
-	err = os.Rename(tempBlock.segment.Name(), filepath.Join(db.dir, db.segmentName+"0"))
-	tempBlock.outPath = tempBlock.segment.Name()
-	if err != nil {
-		return err
-	}
+	db.blocks = []*block{merged, db.blocks[len(db.blocks)-1]}
+	db.merges++
 	return nil
 }
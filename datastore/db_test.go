@@ -1,11 +1,17 @@
 package datastore
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestDb_Put(t *testing.T) {
@@ -72,6 +78,10 @@ func TestDb_Put(t *testing.T) {
 	})
 
 	t.Run("new DB process", func(t *testing.T) {
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
 		db, err = NewDb(dir)
 		if err != nil {
 			t.Fatal(err)
@@ -115,7 +125,7 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatalf("ERROR! Unexpected error: %v", err)
 		}
-		n := len(filesNames)
+		n := countSegments(filesNames)
 		if n != 2 {
 			t.Errorf("ERROR!\nExpected: 2;\nGot: %v", n)
 		}
@@ -162,13 +172,335 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatalf("ERROR! Unexpected error: %v", err)
 		}
-		n := len(filesNames)
+		n := countSegments(filesNames)
 		if n != 2 {
 			t.Errorf("ERROR!\nExpected: 2;\nGot: %v", n)
 		}
+
+		value, err := db.Get(pairs[1][0])
+		if err != nil {
+			t.Errorf("ERROR! Can't get %s after merge: %s", pairs[1][0], err)
+		}
+		if value != pairs[1][1] {
+			t.Errorf("ERROR!\nExpected: %s;\nGot: %s", pairs[1][1], value)
+		}
+	})
+}
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Put("key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("second writer", func(t *testing.T) {
+		_, err := NewDb(dir)
+		if err != ErrLocked {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrLocked, err)
+		}
+	})
+
+	t.Run("read-only open", func(t *testing.T) {
+		roDb, err := NewDb(dir, ReadOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer roDb.Close()
+
+		value, err := roDb.Get("key")
+		if err != nil {
+			t.Errorf("ERROR! Can't get key: %s", err)
+		}
+		if value != "value" {
+			t.Errorf("ERROR!\nExpected: value;\nGot: %s", value)
+		}
+		err = roDb.Put("key", "other")
+		if err != ErrReadOnly {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrReadOnly, err)
+		}
+	})
+
+	t.Run("read-only open during a write", func(t *testing.T) {
+		active := db.blocks[len(db.blocks)-1].outPath
+		info, err := os.Stat(active)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Truncate(active, info.Size())
+		record := (&entry{key: "other", vType: "string", value: "being written"}).Encode()
+		f, err := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write(record[:len(record)-4])
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roDb, err := NewDb(dir, ReadOnly())
+		if err != nil {
+			t.Fatalf("ERROR! Can't open a segment being written: %s", err)
+		}
+		defer roDb.Close()
+
+		value, err := roDb.Get("key")
+		if err != nil {
+			t.Errorf("ERROR! Can't get key: %s", err)
+		}
+		if value != "value" {
+			t.Errorf("ERROR!\nExpected: value;\nGot: %s", value)
+		}
+		_, err = roDb.Get("other")
+		if err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("reopen after close", func(t *testing.T) {
+		err := db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	})
+}
+
+func TestDb_Recover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, segment := range []struct {
+		name, value string
+	}{
+		{"segment-2", "old"},
+		{"segment-10", "new"},
+		{"segment-1-temp", "broken"},
+	} {
+		b, err := newBlock(dir, segment.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.put("key", "string", segment.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.close()
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, ".DS_Store"), []byte("junk"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatalf("ERROR! Can't recover: %s", err)
+	}
+	defer db.Close()
+
+	value, err := db.Get("key")
+	if err != nil {
+		t.Errorf("ERROR! Can't get key: %s", err)
+	}
+	if value != "new" {
+		t.Errorf("ERROR!\nExpected: new;\nGot: %s", value)
+	}
+	if db.segmentNumber != 10 {
+		t.Errorf("ERROR!\nExpected: 10;\nGot: %d", db.segmentNumber)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "segment-1-temp")); !os.IsNotExist(err) {
+		t.Errorf("ERROR! Incomplete merge file was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".DS_Store")); err != nil {
+		t.Errorf("ERROR! Unknown file should be left alone: %v", err)
+	}
+}
+
+func TestDb_Range(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.segmentSize = 200
+
+	keys := []string{"pear", "apple", "kiwi", "banana", "cherry", "lime", "fig", "grape", "date", "mango"}
+	for round := 0; round < 3; round++ {
+		for _, key := range keys {
+			err := db.Put(key, fmt.Sprintf("%s-%d", key, round))
+			if err != nil {
+				t.Fatalf("ERROR! Can't put %s: %s", key, err)
+			}
+		}
+	}
+
+	check := func(db *Db) {
+		got, err := db.Range("banana", "kiwi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"banana", "cherry", "date", "fig", "grape"}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", expected, got)
+		}
+
+		got, err = db.Range("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(keys) || !sort.StringsAreSorted(got) {
+			t.Errorf("ERROR! Unexpected full range: %v", got)
+		}
+
+		for _, key := range keys {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Errorf("ERROR! Can't get %s: %s", key, err)
+			}
+			if expected := key + "-2"; value != expected {
+				t.Errorf("ERROR!\nExpected: %s;\nGot: %s", expected, value)
+			}
+		}
+	}
+	check(db)
+	if db.blocks[0].sorted == nil {
+		t.Error("ERROR! Merged segment is not sorted")
+	}
+
+	db.Close()
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.blocks[0].sorted == nil {
+		t.Error("ERROR! Merged segment is not recognized as sorted")
+	}
+	check(db)
+}
+
+func TestDb_PutStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, MaxKeySize(16), MaxValueSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte("0123456789"), 100000)
+
+	t.Run("stream in and out", func(t *testing.T) {
+		err := db.PutStream("big", bytes.NewReader(value), int64(len(value)))
+		if err != nil {
+			t.Fatalf("ERROR! Can't put: %s", err)
+		}
+		r, size, err := db.GetStream("big")
+		if err != nil {
+			t.Fatalf("ERROR! Can't get: %s", err)
+		}
+		defer r.Close()
+		if size != int64(len(value)) {
+			t.Errorf("ERROR!\nExpected: %d;\nGot: %d", len(value), size)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Error("ERROR! Streamed value differs")
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		err := db.PutStream("huge", bytes.NewReader(append(value, value...)), -1)
+		if err != ErrValueTooLarge {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrValueTooLarge, err)
+		}
+		err = db.Put("a-very-long-key-over-the-limit", "value")
+		if err != ErrKeyTooLarge {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrKeyTooLarge, err)
+		}
+	})
+
+	t.Run("short body", func(t *testing.T) {
+		err := db.PutStream("short", bytes.NewReader(value[:10]), 20)
+		if err == nil {
+			t.Error("ERROR! Short body was accepted")
+		}
+		if _, err := db.Get("short"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	})
+
+	t.Run("recover big records", func(t *testing.T) {
+		err := db.Put("small", "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		got, err := db.Get("big")
+		if err != nil {
+			t.Fatalf("ERROR! Can't get: %s", err)
+		}
+		if got != string(value) {
+			t.Error("ERROR! Recovered value differs")
+		}
+		if got, _ := db.Get("small"); got != "value" {
+			t.Errorf("ERROR!\nExpected: value;\nGot: %s", got)
+		}
+
+		filesNames, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filesNames) != 2 {
+			t.Errorf("ERROR! Unexpected files left in the directory: %v", filesNames)
+		}
 	})
 }
 
+func countSegments(filesNames []string) int {
+	n := 0
+	for _, name := range filesNames {
+		if name != lockFileName {
+			n++
+		}
+	}
+	return n
+}
+
 func TestDb_PutInt64(t *testing.T) {
 	dir, err := ioutil.TempDir("", "test-db")
 	if err != nil {
@@ -211,4 +543,236 @@ func TestDb_PutInt64(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		_, err := db.Get(pairs[0].key)
+		if err != ErrWrongType {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrWrongType, err)
+		}
+	})
+}
+
+func TestDb_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.segmentSize = 100
+
+	for i := 0; i < 10; i++ {
+		err := db.Put(fmt.Sprintf("key%d", i), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"key1", "key5", "missing"} {
+		deleted, err := db.Delete(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != (key != "missing") {
+			t.Errorf("ERROR! Unexpected result of deleting %s: %t", key, deleted)
+		}
+	}
+	if deleted, _ := db.Delete("key1"); deleted {
+		t.Error("ERROR! Deleted key was deleted again")
+	}
+
+	check := func(db *Db) {
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+		if ok, _ := db.Exists("key5"); ok {
+			t.Error("ERROR! Deleted key exists")
+		}
+		keys, err := db.Range("key", "kez")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"key0", "key2", "key3", "key4", "key6", "key7", "key8", "key9"}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", expected, keys)
+		}
+	}
+	check(db)
+
+	// merges drop the deleted keys
+	for i := 0; i < 10; i++ {
+		err := db.Put(fmt.Sprintf("other%d", i), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(db)
+
+	db.Close()
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+
+	err = db.Put("key1", "again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get("key1"); value != "again" {
+		t.Errorf("ERROR!\nExpected: %s;\nGot: %s", "again", value)
+	}
+}
+
+func TestDb_Expire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	now := time.Unix(1000, 0)
+	db.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "c"} {
+		err := db.Put(key, "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := db.Expire("a", time.Minute); !ok || err != nil {
+		t.Fatalf("ERROR! Can't expire a: %t %v", ok, err)
+	}
+	if ok, _ := db.Expire("b", 0); !ok {
+		t.Error("ERROR! Can't expire b")
+	}
+	if ok, _ := db.Expire("missing", time.Minute); ok {
+		t.Error("ERROR! Expired a missing key")
+	}
+
+	if value, err := db.Get("a"); value != "value" || err != nil {
+		t.Errorf("ERROR! Value expired too early: %s %v", value, err)
+	}
+	if _, err := db.Get("b"); err != ErrNotFound {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := db.Get("a"); err != ErrNotFound {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+	}
+	if _, _, err := db.GetStream("a"); err != ErrNotFound {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+	}
+	keys, err := db.Range("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"c"}) {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", []string{"c"}, keys)
+	}
+
+	// a new value doesn't inherit the expiration
+	db.Expire("c", time.Second)
+	db.Put("c", "new")
+	now = now.Add(time.Hour)
+	if value, _ := db.Get("c"); value != "new" {
+		t.Errorf("ERROR!\nExpected: %s;\nGot: %s", "new", value)
+	}
+}
+
+func TestDb_IncrBy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const workers, increments = 8, 50
+	done := make(chan error)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := 0; i < increments; i++ {
+				if _, err := db.IncrBy("counter", 2); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := db.GetInt64("counter"); n != workers*increments*2 {
+		t.Errorf("ERROR!\nExpected: %d;\nGot: %d", workers*increments*2, n)
+	}
+
+	db.Put("number", "41")
+	if n, err := db.IncrBy("number", 1); n != 42 || err != nil {
+		t.Errorf("ERROR! Can't increment a decimal string: %d %v", n, err)
+	}
+	db.Put("text", "forty")
+	if _, err := db.IncrBy("text", 1); err != ErrWrongType {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrWrongType, err)
+	}
+	db.PutInt64("max", math.MaxInt64)
+	if _, err := db.IncrBy("max", 1); err != ErrOverflow {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrOverflow, err)
+	}
+
+	now := time.Now()
+	db.now = func() time.Time { return now }
+	db.Expire("counter", time.Minute)
+	db.IncrBy("counter", 1)
+	now = now.Add(time.Minute)
+	if ok, _ := db.Exists("counter"); ok {
+		t.Error("ERROR! Increment cleared the expiration")
+	}
+}
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"d", "b", "a", "e", "c"} {
+		db.Put(key, "value")
+	}
+	var keys []string
+	err = db.Scan("b", func(key string) bool {
+		keys = append(keys, key)
+		return len(keys) < 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"b", "c", "d"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", expected, keys)
+	}
 }
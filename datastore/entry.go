@@ -3,120 +3,127 @@ package datastore
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
+	"io"
+	"time"
 )
 
 type entry struct {
-	key   string
-	vType string
-	value string
+	key       string
+	vType     string
+	value     string
+	expiresAt int64 // unix time in nanoseconds, 0 if the record never expires
 }
 
+func (e *entry) header() recordHeader {
+	return recordHeader{key: e.key, vType: e.vType, valueSize: int64(len(e.value)), expiresAt: e.expiresAt}
+}
+
+// tombstoneType marks a record that removes the key.
+const tombstoneType = "tombstone"
+
 func (e *entry) Encode() []byte {
-	kl := len(e.key)
-	tl := len(e.vType)
-	vl := len(e.value)
-	size := kl + tl + vl + 16
-	res := make([]byte, size)
-	binary.LittleEndian.PutUint32(res, uint32(size))
+	var trailerSize int64
+	if e.expiresAt != 0 {
+		trailerSize = 8
+	}
+	header := encodeHeader(e.key, e.vType, int64(len(e.value)), trailerSize)
+	res := make([]byte, int64(len(header)+len(e.value))+trailerSize)
+	copy(res, header)
+	copy(res[len(header):], e.value)
+	if trailerSize > 0 {
+		binary.LittleEndian.PutUint64(res[len(header)+len(e.value):], uint64(e.expiresAt))
+	}
+	return res
+}
+
+// encodeHeader encodes all fields of a record before the value, so a value
+// of valueSize bytes and trailerSize bytes of optional fields can follow it.
+func encodeHeader(key, vType string, valueSize, trailerSize int64) []byte {
+	kl := len(key)
+	tl := len(vType)
+	res := make([]byte, kl+tl+16)
+	binary.LittleEndian.PutUint32(res, uint32(int64(len(res))+valueSize+trailerSize))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
+	copy(res[8:], key)
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(tl))
-	copy(res[kl+12:], e.vType)
-	binary.LittleEndian.PutUint32(res[kl+tl+12:], uint32(vl))
-	copy(res[kl+tl+16:], e.value)
+	copy(res[kl+12:], vType)
+	binary.LittleEndian.PutUint32(res[kl+tl+12:], uint32(valueSize))
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
-	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
-	e.key = string(keyBuf)
-
-	tl := binary.LittleEndian.Uint32(input[kl+8:])
-	tValBuf := make([]byte, tl)
-	copy(tValBuf, input[kl+12:kl+12+tl])
-	e.vType = string(tValBuf)
-
-	vl := binary.LittleEndian.Uint32(input[kl+tl+12:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+tl+16:kl+tl+16+vl])
-	e.value = string(valBuf)
+// recordHeader describes a record of a segment without reading its value.
+type recordHeader struct {
+	key        string
+	vType      string
+	valueSize  int64
+	headerSize int64 // bytes before the value
+	expiresAt  int64
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
-	if err != nil {
-		return "", err
-	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", err
-	}
+// live reports whether the record holds a value that is not removed or expired.
+func (h recordHeader) live(now time.Time) bool {
+	return h.vType != tombstoneType && (h.expiresAt == 0 || h.expiresAt > now.UnixNano())
+}
 
-	header, err = in.Peek(4)
+// readRecordHeader reads all fields but the value of the record at position of src.
+func readRecordHeader(src io.ReaderAt, position int64) (recordHeader, error) {
+	in := bufio.NewReaderSize(io.NewSectionReader(src, position, 1<<62), 512)
+	header := make([]byte, 8)
+	_, err := io.ReadFull(in, header)
 	if err != nil {
-		return "", err
+		return recordHeader{}, err
 	}
-	vTypeSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(vTypeSize + 4)
+	size := int64(binary.LittleEndian.Uint32(header))
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	data := make([]byte, kl+4)
+	_, err = io.ReadFull(in, data)
 	if err != nil {
-		return "", err
+		return recordHeader{}, err
 	}
+	h := recordHeader{key: string(data[:kl])}
 
-	header, err = in.Peek(4)
-	if err != nil {
-		return "", err
-	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
+	tl := int64(binary.LittleEndian.Uint32(data[kl:]))
+	data = make([]byte, tl+4)
+	_, err = io.ReadFull(in, data)
 	if err != nil {
-		return "", err
+		return recordHeader{}, err
 	}
+	h.vType = string(data[:tl])
+	h.valueSize = int64(binary.LittleEndian.Uint32(data[tl:]))
+	h.headerSize = kl + tl + 16
 
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
-	if err != nil {
-		return "", err
+	if size >= h.headerSize+h.valueSize+8 {
+		trailer := make([]byte, 8)
+		_, err = readFullAt(src, trailer, position+h.headerSize+h.valueSize)
+		if err != nil {
+			return recordHeader{}, err
+		}
+		h.expiresAt = int64(binary.LittleEndian.Uint64(trailer))
 	}
-	if n != valSize {
-		return "", fmt.Errorf("ERROR!\nExpected: %d;\nRead: %d)", valSize, n)
-	}
-
-	return string(data), nil
+	return h, nil
 }
 
-func readType(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
-	if err != nil {
-		return "", err
-	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", err
-	}
-
-	header, err = in.Peek(4)
+// readRecord reads the whole record at position of src.
+func readRecord(src io.ReaderAt, position int64) (entry, error) {
+	h, err := readRecordHeader(src, position)
 	if err != nil {
-		return "", err
+		return entry{}, err
 	}
-	vTypeSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
+	value := make([]byte, h.valueSize)
+	_, err = readFullAt(src, value, position+h.headerSize)
 	if err != nil {
-		return "", err
+		return entry{}, err
 	}
+	return entry{h.key, h.vType, string(value), h.expiresAt}, nil
+}
 
-	data := make([]byte, vTypeSize)
-	n, err := in.Read(data)
-	if err != nil {
-		return "", err
+func readFullAt(src io.ReaderAt, data []byte, offset int64) (int, error) {
+	n, err := src.ReadAt(data, offset)
+	if err == io.EOF && n == len(data) {
+		err = nil
 	}
-	if n != vTypeSize {
-		return "", fmt.Errorf("ERROR!\nExpected: %d;\nRead: %d)", vTypeSize, n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-
-	return string(data), nil
+	return n, err
 }
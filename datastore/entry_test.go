@@ -1,42 +1,53 @@
 package datastore
 
 import (
-	"bufio"
 	"bytes"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "string", "value"}
-	e.Decode(e.Encode())
-	if e.key != "key" {
-		t.Error("ERROR! Incorrect key")
+	e := entry{key: "key", vType: "string", value: "value"}
+	r, err := readRecord(bytes.NewReader(e.Encode()), 0)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if e.value != "value" {
-		t.Error("ERROR! Incorrect value")
+	if r != e {
+		t.Errorf("ERROR!\nExpected: %+v;\nGot: %+v", e, r)
+	}
+
+	e = entry{key: "key", vType: "string", value: "value", expiresAt: 42}
+	r, err = readRecord(bytes.NewReader(e.Encode()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != e {
+		t.Errorf("ERROR! Incorrect expiring entry\nExpected: %+v;\nGot: %+v", e, r)
 	}
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "string", "test-value"}
-	data := e.Encode()
-	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	e := entry{key: "key", vType: "string", value: "test-value"}
+	data := append([]byte("junk"), e.Encode()...)
+	r, err := readRecord(bytes.NewReader(data), 4)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if v != "test-value" {
-		t.Errorf("ERROR! Got bad value [%s]", v)
+	if r.value != "test-value" {
+		t.Errorf("ERROR! Got bad value [%s]", r.value)
 	}
 }
 
 func TestReadType(t *testing.T) {
-	e := entry{"key", "int64", "test-value"}
+	e := entry{key: "key", vType: "int64", value: "test-value", expiresAt: 42}
 	data := e.Encode()
-	vt, err := readType(bufio.NewReader(bytes.NewReader(data)))
+	h, err := readRecordHeader(bytes.NewReader(data), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if vt != "int64" {
-		t.Errorf("ERROR! Got bad value type [%s]", vt)
+	if h.vType != "int64" {
+		t.Errorf("ERROR! Got bad value type [%s]", h.vType)
+	}
+	if h.expiresAt != 42 {
+		t.Errorf("ERROR! Got bad expiration [%d]", h.expiresAt)
 	}
 }
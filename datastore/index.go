@@ -0,0 +1,220 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const indexSuffix = ".idx"
+const defaultIndexStep = 64
+
+var errStaleIndex = fmt.Errorf("index file does not match its segment")
+
+type hashIndex map[string]int64
+
+// fence points at the first of a run of entries in the index file.
+type fence struct {
+	key    string
+	offset int64
+}
+
+// sparseIndex serves a sealed segment from a sorted index file on disk.
+// Only every step-th key is kept in memory as a fence pointer, so a lookup
+// reads at most one run of step entries from the file.
+type sparseIndex struct {
+	path        string
+	fences      []fence
+	size        int64 // size of the index file
+	segmentSize int64 // size of the segment the index was built for
+}
+
+// writeSparseIndex writes the sorted keys of a memtable with their offsets
+// to path. The file is written next to its final name and renamed, so a
+// crash never leaves a half-written index behind.
+func writeSparseIndex(path string, segmentSize int64, index *memtable, step int) (*sparseIndex, error) {
+	keys := index.sortedKeys()
+
+	tempPath := path + tempSuffix
+	f, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempPath)
+	defer f.Close()
+
+	si := &sparseIndex{path: path, segmentSize: segmentSize}
+	out := bufio.NewWriter(f)
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint64(header, uint64(segmentSize))
+	_, err = out.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	si.size = int64(len(header))
+
+	for i, key := range keys {
+		if i%step == 0 {
+			si.fences = append(si.fences, fence{key, si.size})
+		}
+		n, err := writeIndexEntry(out, key, index.offsets[key])
+		if err != nil {
+			return nil, err
+		}
+		si.size += n
+	}
+
+	err = out.Flush()
+	if err != nil {
+		return nil, err
+	}
+	err = f.Sync()
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// loadSparseIndex rebuilds the fence pointers of an existing index file.
+// It returns errStaleIndex if the file was built for a segment of another size.
+func loadSparseIndex(path string, segmentSize int64, step int) (*sparseIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	in := bufio.NewReaderSize(f, bufSize)
+	header := make([]byte, 8)
+	_, err = io.ReadFull(in, header)
+	if err != nil {
+		return nil, err
+	}
+	if int64(binary.LittleEndian.Uint64(header)) != segmentSize {
+		return nil, errStaleIndex
+	}
+
+	si := &sparseIndex{path: path, segmentSize: segmentSize, size: int64(len(header))}
+	for i := 0; ; i++ {
+		key, _, n, err := readIndexEntry(in)
+		if err == io.EOF {
+			return si, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i%step == 0 {
+			si.fences = append(si.fences, fence{key, si.size})
+		}
+		si.size += n
+	}
+}
+
+func (si *sparseIndex) get(key string) (int64, bool, error) {
+	i := findFence(si.fences, key)
+	if i < 0 {
+		return 0, false, nil
+	}
+	end := si.size
+	if i+1 < len(si.fences) {
+		end = si.fences[i+1].offset
+	}
+
+	f, err := os.Open(si.path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	start := si.fences[i].offset
+	in := bufio.NewReader(io.NewSectionReader(f, start, end-start))
+	for {
+		k, offset, _, err := readIndexEntry(in)
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if k == key {
+			return offset, true, nil
+		}
+		if k > key {
+			return 0, false, nil
+		}
+	}
+}
+
+func (si *sparseIndex) iterate(start string) (keyIterator, error) {
+	f, err := os.Open(si.path)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := int64(8)
+	if i := findFence(si.fences, start); i >= 0 {
+		offset = si.fences[i].offset
+	}
+	return &indexFileIterator{
+		f:     f,
+		in:    bufio.NewReaderSize(io.NewSectionReader(f, offset, si.size-offset), bufSize),
+		start: start,
+	}, nil
+}
+
+type indexFileIterator struct {
+	f     *os.File
+	in    *bufio.Reader
+	start string
+}
+
+func (it *indexFileIterator) next() (string, int64, error) {
+	for {
+		key, offset, _, err := readIndexEntry(it.in)
+		if err != nil {
+			return "", 0, err
+		}
+		if key >= it.start {
+			return key, offset, nil
+		}
+	}
+}
+
+func (it *indexFileIterator) close() error {
+	return it.f.Close()
+}
+
+func writeIndexEntry(out io.Writer, key string, offset int64) (int64, error) {
+	data := make([]byte, len(key)+12)
+	binary.LittleEndian.PutUint32(data, uint32(len(key)))
+	copy(data[4:], key)
+	binary.LittleEndian.PutUint64(data[len(key)+4:], uint64(offset))
+	n, err := out.Write(data)
+	return int64(n), err
+}
+
+func readIndexEntry(in io.Reader) (string, int64, int64, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(in, header)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	kl := int(binary.LittleEndian.Uint32(header))
+	data := make([]byte, kl+8)
+	_, err = io.ReadFull(in, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", 0, 0, err
+	}
+	offset := int64(binary.LittleEndian.Uint64(data[kl:]))
+	return string(data[:kl]), offset, int64(kl + 12), nil
+}
@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index := newMemtable()
+	for i := 99; i >= 0; i-- {
+		index.set(fmt.Sprintf("key%03d", i), int64(i*10))
+	}
+	path := filepath.Join(dir, "segment-1"+indexSuffix)
+
+	written, err := writeSparseIndex(path, 1000, index, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written.fences) != 13 {
+		t.Errorf("ERROR!\nExpected: 13 fences;\nGot: %d", len(written.fences))
+	}
+
+	loaded, err := loadSparseIndex(path, 1000, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, si := range []*sparseIndex{written, loaded} {
+		for key, expected := range index.offsets {
+			offset, ok, err := si.get(key)
+			if err != nil || !ok {
+				t.Fatalf("ERROR! Can't find %s: %v", key, err)
+			}
+			if offset != expected {
+				t.Errorf("ERROR!\nExpected: %d;\nGot: %d", expected, offset)
+			}
+		}
+		for _, key := range []string{"a", "key0005", "key100", "z"} {
+			if _, ok, _ := si.get(key); ok {
+				t.Errorf("ERROR! Found missing key %s", key)
+			}
+		}
+	}
+
+	it, err := loaded.iterate("key050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.close()
+	var keys []string
+	for {
+		key, _, err := it.next()
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) != 50 || keys[0] != "key050" || keys[49] != "key099" {
+		t.Errorf("ERROR! Unexpected keys: %v", keys)
+	}
+
+	if _, err := loadSparseIndex(path, 999, 8); err != errStaleIndex {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", errStaleIndex, err)
+	}
+}
+
+func TestDb_SparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, SparseIndex(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.segmentSize = 300
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 20; i++ {
+			err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, round))
+			if err != nil {
+				t.Fatalf("ERROR! Can't put: %s", err)
+			}
+		}
+	}
+	for _, b := range db.blocks[:len(db.blocks)-1] {
+		if b.index != nil {
+			t.Error("ERROR! Sealed segment is still indexed in memory")
+		}
+	}
+
+	check := func(db *Db) {
+		for i := 0; i < 20; i++ {
+			value, err := db.Get(fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Errorf("ERROR! Can't get key%d: %s", i, err)
+			}
+			if expected := fmt.Sprintf("value%d-2", i); value != expected {
+				t.Errorf("ERROR!\nExpected: %s;\nGot: %s", expected, value)
+			}
+		}
+	}
+	check(db)
+
+	db.Close()
+	db, err = NewDb(dir, SparseIndex(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+// BenchmarkIndex compares the heap held by the index of a sealed segment
+// and the latency of a key lookup for the index modes: the memtable, the
+// sparse index file of unmerged segments and the block index of merged ones.
+func BenchmarkIndex(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench-index")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const keysCount = 100000
+	keys := make([]string, keysCount)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("some-reasonably-long-key-%08d", i)
+	}
+
+	build := map[string]func() *block{
+		"hash": func() *block {
+			index := newMemtable()
+			for i, key := range keys {
+				index.set(strings.Clone(key), int64(i))
+			}
+			return &block{index: index}
+		},
+	}
+	for _, step := range []int{16, 64, 256} {
+		step := step
+		build[fmt.Sprintf("sparse-%d", step)] = func() *block {
+			index := newMemtable()
+			for i, key := range keys {
+				index.set(strings.Clone(key), int64(i))
+			}
+			path := filepath.Join(dir, fmt.Sprintf("segment-%d%s", step, indexSuffix))
+			sparse, err := writeSparseIndex(path, 0, index, step)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return &block{sparse: sparse}
+		}
+	}
+
+	build["sorted"] = func() *block {
+		path := filepath.Join(dir, "segment-sorted")
+		var data []byte
+		for _, key := range keys {
+			data = append(data, (&entry{key: key, vType: "string", value: "value"}).Encode()...)
+		}
+		err := ioutil.WriteFile(path, data, 0o600)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sorted, err := scanSortedSegment(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return &block{sorted: sorted, outPath: path}
+	}
+
+	for _, name := range []string{"hash", "sparse-16", "sparse-64", "sparse-256", "sorted"} {
+		b.Run(name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			bl := build[name]()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok, err := bl.lookup(keys[i%keysCount]); !ok || err != nil {
+					b.Fatalf("lookup failed: %v", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/keysCount, "heap-B/key")
+			runtime.KeepAlive(bl)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"io"
+	"sort"
+)
+
+// keyIterator walks the keys of a block in ascending order. next returns
+// io.EOF once there are no keys left.
+type keyIterator interface {
+	next() (key string, offset int64, err error)
+	close() error
+}
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+type sliceIterator struct {
+	entries []indexEntry
+}
+
+func (it *sliceIterator) next() (string, int64, error) {
+	if len(it.entries) == 0 {
+		return "", 0, io.EOF
+	}
+	e := it.entries[0]
+	it.entries = it.entries[1:]
+	return e.key, e.offset, nil
+}
+
+func (it *sliceIterator) close() error {
+	return nil
+}
+
+// findFence returns the last fence whose key is not greater than key, or -1.
+func findFence(fences []fence, key string) int {
+	return sort.Search(len(fences), func(i int) bool {
+		return fences[i].key > key
+	}) - 1
+}
+
+type cursor struct {
+	it     keyIterator
+	block  *block
+	key    string
+	offset int64
+	done   bool
+}
+
+func (c *cursor) advance() error {
+	var err error
+	c.key, c.offset, err = c.it.next()
+	if err == io.EOF {
+		c.done = true
+		return nil
+	}
+	return err
+}
+
+// mergeBlocks walks the keys in [start, end) of all blocks in ascending order
+// and calls fn with the newest record of every key. Blocks are ordered from
+// the oldest to the newest one, an empty end means there is no upper bound.
+func mergeBlocks(blocks []*block, start, end string, fn func(key string, b *block, offset int64) error) error {
+	cursors := make([]*cursor, 0, len(blocks))
+	defer func() {
+		for _, c := range cursors {
+			c.it.close()
+		}
+	}()
+
+	for _, b := range blocks {
+		it, err := b.iterate(start)
+		if err != nil {
+			return err
+		}
+		c := &cursor{it: it, block: b}
+		cursors = append(cursors, c)
+		err = c.advance()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		var newest *cursor
+		for _, c := range cursors {
+			if !c.done && (newest == nil || c.key <= newest.key) {
+				newest = c
+			}
+		}
+		if newest == nil || (end != "" && newest.key >= end) {
+			return nil
+		}
+
+		key := newest.key
+		err := fn(key, newest.block, newest.offset)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range cursors {
+			if !c.done && c.key == key {
+				err = c.advance()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
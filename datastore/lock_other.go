@@ -0,0 +1,18 @@
+//go:build !unix
+
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir only creates the lock file on platforms without flock,
+// so the directory is not protected from concurrent writers there.
+func lockDir(dir string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0o600)
+}
+
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
@@ -0,0 +1,42 @@
+package datastore
+
+import "sort"
+
+// memtable indexes a segment that is still being written. New keys are
+// appended as they come and sorted only when an ordered walk is requested.
+type memtable struct {
+	offsets hashIndex
+	keys    []string
+	sorted  bool
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		offsets: make(hashIndex),
+		sorted:  true,
+	}
+}
+
+func (m *memtable) get(key string) (int64, bool) {
+	offset, ok := m.offsets[key]
+	return offset, ok
+}
+
+func (m *memtable) set(key string, offset int64) {
+	if _, ok := m.offsets[key]; !ok {
+		if n := len(m.keys); n > 0 && m.keys[n-1] > key {
+			m.sorted = false
+		}
+		m.keys = append(m.keys, key)
+	}
+	m.offsets[key] = offset
+}
+
+// sortedKeys sorts the keys in place, callers must hold the write lock of the block.
+func (m *memtable) sortedKeys() []string {
+	if !m.sorted {
+		sort.Strings(m.keys)
+		m.sorted = true
+	}
+	return m.keys
+}
@@ -0,0 +1,209 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// dataBlockSize is the size in bytes of a run of records covered by one fence.
+const dataBlockSize = 4096
+
+var errNotSorted = fmt.Errorf("segment is not sorted by key")
+
+// blockIndex serves a segment whose records are sorted by key. It keeps
+// the first key of every data block of about dataBlockSize bytes, so a
+// lookup reads a single data block from the segment.
+type blockIndex struct {
+	fences []fence
+	size   int64
+}
+
+func (bi *blockIndex) add(key string, size int64) {
+	if len(bi.fences) == 0 || bi.size-bi.fences[len(bi.fences)-1].offset >= dataBlockSize {
+		bi.fences = append(bi.fences, fence{key, bi.size})
+	}
+	bi.size += size
+}
+
+// scanSortedSegment builds the block index of a segment. It returns
+// errNotSorted as soon as it meets a key that is not greater than the previous one.
+func scanSortedSegment(path string) (*blockIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	in := bufio.NewReaderSize(f, bufSize)
+	bi := &blockIndex{}
+	var prev string
+	for {
+		key, size, err := readRecordKey(in)
+		if err == io.EOF {
+			return bi, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bi.size > 0 && key <= prev {
+			return nil, errNotSorted
+		}
+		bi.add(key, size)
+		prev = key
+	}
+}
+
+func (bi *blockIndex) get(path, key string) (int64, bool, error) {
+	i := findFence(bi.fences, key)
+	if i < 0 {
+		return 0, false, nil
+	}
+	end := bi.size
+	if i+1 < len(bi.fences) {
+		end = bi.fences[i+1].offset
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	offset := bi.fences[i].offset
+	in := bufio.NewReaderSize(io.NewSectionReader(f, offset, end-offset), bufSize)
+	for {
+		k, size, err := readRecordKey(in)
+		if err == io.EOF {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if k == key {
+			return offset, true, nil
+		}
+		if k > key {
+			return 0, false, nil
+		}
+		offset += size
+	}
+}
+
+func (bi *blockIndex) iterate(path, start string) (keyIterator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	if i := findFence(bi.fences, start); i >= 0 {
+		offset = bi.fences[i].offset
+	}
+	return &segmentIterator{
+		f:      f,
+		in:     bufio.NewReaderSize(io.NewSectionReader(f, offset, bi.size-offset), bufSize),
+		offset: offset,
+		start:  start,
+	}, nil
+}
+
+type segmentIterator struct {
+	f      *os.File
+	in     *bufio.Reader
+	offset int64
+	start  string
+}
+
+func (it *segmentIterator) next() (string, int64, error) {
+	for {
+		key, size, err := readRecordKey(it.in)
+		if err != nil {
+			return "", 0, err
+		}
+		offset := it.offset
+		it.offset += size
+		if key >= it.start {
+			return key, offset, nil
+		}
+	}
+}
+
+func (it *segmentIterator) close() error {
+	return it.f.Close()
+}
+
+// sortedWriter writes the records of a compacted segment in key order
+// and builds its block index along the way.
+type sortedWriter struct {
+	f     *os.File
+	out   *bufio.Writer
+	index *blockIndex
+}
+
+func createSortedSegment(path string) (*sortedWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &sortedWriter{
+		f:     f,
+		out:   bufio.NewWriterSize(f, bufSize),
+		index: &blockIndex{},
+	}, nil
+}
+
+// copyRecord copies the raw record at offset of src without decoding its value.
+func (w *sortedWriter) copyRecord(key string, src io.ReaderAt, offset int64) error {
+	header := make([]byte, 4)
+	_, err := src.ReadAt(header, offset)
+	if err != nil {
+		return err
+	}
+	size := int64(binary.LittleEndian.Uint32(header))
+
+	w.index.add(key, size)
+	_, err = io.Copy(w.out, io.NewSectionReader(src, offset, size))
+	return err
+}
+
+func (w *sortedWriter) finish() error {
+	err := w.out.Flush()
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// readRecordKey reads the key of the next record and skips the rest of it.
+func readRecordKey(in *bufio.Reader) (string, int64, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(in, header)
+	if err != nil {
+		return "", 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header))
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	if kl+8 > size {
+		return "", 0, fmt.Errorf("corrupted file")
+	}
+
+	key := make([]byte, kl)
+	_, err = io.ReadFull(in, key)
+	if err == nil {
+		_, err = in.Discard(int(size - kl - 8))
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return string(key), size, nil
+}
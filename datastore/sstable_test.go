@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	older, err := newBlock(dir, "segment-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer older.close()
+	newer, err := newBlock(dir, "segment-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newer.close()
+
+	for i := 999; i >= 0; i-- {
+		err := older.put(fmt.Sprintf("key%04d", i), "string", "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 1000; i += 2 {
+		err := newer.put(fmt.Sprintf("key%04d", i), "string", "new")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = newer.put("key0001", tombstoneType, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = newer.putEntry(entry{key: "key0003", vType: "string", value: "new", expiresAt: now.UnixNano()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := compact([]*block{older, newer}, filepath.Join(dir, "segment-0"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.close()
+	if len(merged.sorted.fences) < 2 {
+		t.Errorf("ERROR! Expected several data blocks, got %d", len(merged.sorted.fences))
+	}
+
+	for i := 4; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		e, err := merged.get(key)
+		if err != nil {
+			t.Fatalf("ERROR! Can't get %s: %s", key, err)
+		}
+		expected := "old"
+		if i%2 == 0 {
+			expected = "new"
+		}
+		if e.value != expected {
+			t.Errorf("ERROR!\nExpected: %s;\nGot: %s", expected, e.value)
+		}
+	}
+	for _, key := range []string{"key0001", "key0003", "key10000"} {
+		if _, err := merged.get(key); err != ErrNotFound {
+			t.Errorf("ERROR!\nExpected: %v;\nGot: %v", ErrNotFound, err)
+		}
+	}
+
+	scanned, err := scanSortedSegment(merged.outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned.fences) != len(merged.sorted.fences) || scanned.size != merged.sorted.size {
+		t.Error("ERROR! Rebuilt block index differs from the written one")
+	}
+	if _, err := scanSortedSegment(older.outPath); err != errNotSorted {
+		t.Errorf("ERROR!\nExpected: %v;\nGot: %v", errNotSorted, err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package dbclient is a client of the HTTP API of cmd/db.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = 50 * time.Millisecond
+	maxBackoff     = 2 * time.Second
+)
+
+type Client struct {
+	baseURL string
+	http    *http.Client
+	retries int
+	backoff time.Duration
+}
+
+// Option configures the Client created by New.
+type Option func(*Client)
+
+// WithHTTPClient replaces the pooled HTTP client of the Client.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.http = c
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and the delay
+// before the first retry, which doubles with every next one.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(client *Client) {
+		if retries >= 0 {
+			client.retries = retries
+		}
+		if backoff > 0 {
+			client.backoff = backoff
+		}
+	}
+}
+
+// New returns a client of the database at address, which is either a
+// host:port pair or a base URL like http://db:8100.
+func New(address string, opts ...Option) *Client {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	c := &Client{
+		baseURL: strings.TrimSuffix(address, "/"),
+		http:    &http.Client{Transport: newTransport()},
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// newTransport keeps enough idle connections for a busy server talking to
+// a single database host.
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 100
+	t.MaxIdleConnsPerHost = 32
+	t.IdleConnTimeout = 90 * time.Second
+	t.DialContext = (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	return t
+}
+
+type valueResponse struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Get returns the string stored under key.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := c.getValue(ctx, key, "string", &value)
+	return value, err
+}
+
+// GetInt64 returns the int64 stored under key.
+func (c *Client) GetInt64(ctx context.Context, key string) (int64, error) {
+	var value int64
+	err := c.getValue(ctx, key, "int64", &value)
+	return value, err
+}
+
+func (c *Client) getValue(ctx context.Context, key, vType string, value interface{}) error {
+	var resp valueResponse
+	err := c.do(ctx, http.MethodGet, keyPath(key)+"?type="+vType, nil, &resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Value, value)
+}
+
+// Put stores a string under key.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.put(ctx, key, value, "string")
+}
+
+// PutInt64 stores an int64 under key.
+func (c *Client) PutInt64(ctx context.Context, key string, value int64) error {
+	return c.put(ctx, key, value, "int64")
+}
+
+func (c *Client) put(ctx context.Context, key string, value interface{}, vType string) error {
+	body, err := json.Marshal(struct {
+		Value interface{} `json:"value"`
+		Type  string      `json:"type"`
+	}{value, vType})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, keyPath(key), body, nil)
+}
+
+// Delete removes the value stored under key, it returns ErrNotFound if
+// there is none.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, keyPath(key), nil, nil)
+}
+
+// Scan returns the keys in [start, end) in ascending order, an empty end
+// means the range has no upper bound.
+func (c *Client) Scan(ctx context.Context, start, end string) ([]string, error) {
+	query := url.Values{}
+	if start != "" {
+		query.Set("start", start)
+	}
+	if end != "" {
+		query.Set("end", end)
+	}
+	path := "/db"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var resp struct {
+		Keys []string `json:"keys"`
+	}
+	err := c.do(ctx, http.MethodGet, path, nil, &resp)
+	return resp.Keys, err
+}
+
+func keyPath(key string) string {
+	return "/db/" + url.PathEscape(key)
+}
+
+// do sends the request, retrying it while the database is unreachable or
+// temporarily unavailable, and decodes a successful JSON answer into out.
+// All requests of the API are idempotent, so they are safe to repeat.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, path, body, out)
+		if err == nil || attempt >= c.retries || !retryable(err) {
+			return err
+		}
+
+		// full jitter keeps servers restarted together from retrying in step
+		delay := time.Duration(rand.Int63n(int64(backoff)) + 1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return readError(resp)
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body) // lets the connection be reused
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func retryable(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	// the request was cancelled by the caller, there is no point in retrying
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
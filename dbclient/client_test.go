@@ -0,0 +1,184 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type storedValue struct {
+	value interface{}
+	vType string
+}
+
+// fakeDb serves the subset of the cmd/db API the client uses.
+func fakeDb(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	values := map[string]storedValue{}
+	sendError := func(rw http.ResponseWriter, status int, code string) {
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"error": map[string]string{"code": code, "message": code},
+		})
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/db" {
+			var keys []string
+			for key := range values {
+				if key >= r.URL.Query().Get("start") && (r.URL.Query().Get("end") == "" || key < r.URL.Query().Get("end")) {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			json.NewEncoder(rw).Encode(map[string]interface{}{"keys": keys})
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, "/db/")
+		stored, ok := values[key]
+		switch r.Method {
+		case http.MethodGet:
+			switch {
+			case !ok:
+				sendError(rw, http.StatusNotFound, "not_found")
+			case stored.vType != r.URL.Query().Get("type"):
+				sendError(rw, http.StatusConflict, "wrong_type")
+			default:
+				json.NewEncoder(rw).Encode(map[string]interface{}{"key": key, "value": stored.value})
+			}
+		case http.MethodPost:
+			var body struct {
+				Value interface{} `json:"value"`
+				Type  string      `json:"type"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			values[key] = storedValue{body.Value, body.Type}
+			rw.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			if !ok {
+				sendError(rw, http.StatusNotFound, "not_found")
+				return
+			}
+			delete(values, key)
+			rw.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func TestClient(t *testing.T) {
+	server := fakeDb(t)
+	defer server.Close()
+	c := New(server.URL)
+	ctx := context.Background()
+
+	require.NoError(t, c.Put(ctx, "team/name", "value"))
+	require.NoError(t, c.PutInt64(ctx, "counter", 1<<40))
+
+	value, err := c.Get(ctx, "team/name")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	n, err := c.GetInt64(ctx, "counter")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<40), n)
+
+	_, err = c.GetInt64(ctx, "team/name")
+	assert.ErrorIs(t, err, ErrWrongType)
+	var apiErr *Error
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, "wrong_type", apiErr.Code)
+
+	keys, err := c.Scan(ctx, "a", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"counter", "team/name"}, keys)
+	keys, err = c.Scan(ctx, "", "d")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"counter"}, keys)
+
+	assert.NoError(t, c.Delete(ctx, "counter"))
+	assert.ErrorIs(t, c.Delete(ctx, "counter"), ErrNotFound)
+	_, err = c.Get(ctx, "counter")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestClient_Retries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1, 2:
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			rw.Write([]byte(`{"key":"key","value":"value"}`))
+		}
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+	value, err := c.Get(context.Background(), "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	c = New(server.URL, WithRetries(1, time.Millisecond))
+	_, err = c.Get(context.Background(), "key")
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestClient_NoRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+	_, err := c.Get(context.Background(), "key")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "client errors must not be retried")
+}
+
+func TestClient_Context(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(100, time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := c.Put(ctx, "key", "value")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestClient_Unreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	address := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	c := New(address, WithRetries(2, time.Millisecond))
+	_, err := c.Get(context.Background(), "key")
+	assert.Error(t, err)
+	var apiErr *Error
+	assert.False(t, errors.As(err, &apiErr))
+}
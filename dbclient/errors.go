@@ -0,0 +1,74 @@
+package dbclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Errors matched by errors.Is against the errors returned by the Client.
+var (
+	ErrNotFound    = fmt.Errorf("record does not exist")
+	ErrWrongType   = fmt.Errorf("value has a different type")
+	ErrTooLarge    = fmt.Errorf("key or value is too large")
+	ErrBadRequest  = fmt.Errorf("request is rejected by the database")
+	ErrUnavailable = fmt.Errorf("database is unavailable")
+)
+
+// Error is an error answer of the database.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("database answered %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("database answered %d: %s", e.Status, e.Message)
+}
+
+// Is maps the status of the answer to the errors of the package.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrWrongType:
+		return e.Status == http.StatusConflict
+	case ErrTooLarge:
+		return e.Status == http.StatusRequestEntityTooLarge
+	case ErrBadRequest:
+		return e.Status/100 == 4 && e.Status != http.StatusNotFound && e.Status != http.StatusConflict &&
+			e.Status != http.StatusRequestEntityTooLarge
+	case ErrUnavailable:
+		return e.Temporary()
+	}
+	return false
+}
+
+// Temporary reports whether the request may succeed if it is repeated.
+func (e *Error) Temporary() bool {
+	switch e.Status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func readError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+	}
+	return e
+}
@@ -0,0 +1,82 @@
+package httptools
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dimdim28/lab4-software-architecture/metrics"
+)
+
+// MetricsPath is served by every server created by CreateServer.
+const MetricsPath = "/metrics"
+
+var (
+	requestsTotal = metrics.NewCounterVec("http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	requestDuration = metrics.NewHistogramVec("http_request_duration_seconds",
+		"Time spent serving HTTP requests by route and method.", nil, "route", "method")
+	requestsInFlight = metrics.NewGauge("http_requests_in_flight",
+		"HTTP requests being served.")
+)
+
+// instrument records the requests served by handler. Requests are labeled
+// with the pattern of the ServeMux route they match rather than their path,
+// so the number of series stays bounded.
+func instrument(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		route := routeOf(handler, r)
+		start := time.Now()
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+
+		sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		handler.ServeHTTP(sw, r)
+
+		requestsTotal.With(route, r.Method, strconv.Itoa(sw.status)).Inc()
+		requestDuration.With(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+func routeOf(handler http.Handler, r *http.Request) string {
+	mux, ok := handler.(*http.ServeMux)
+	if !ok {
+		return "*"
+	}
+	if _, pattern := mux.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "unmatched"
+}
+
+// statusWriter remembers the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,40 @@
+package httptools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrument(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("OK"))
+	})
+	handler := instrument(mux)
+
+	before := requestsTotal.With("/db/", "GET", "404").Value()
+	beforeHealth := requestsTotal.With("/health", "GET", "200").Value()
+	beforeUnmatched := requestsTotal.With("unmatched", "GET", "404").Value()
+	for _, path := range []string{"/db/a", "/db/b", "/health", "/nothing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	assert.Equal(t, before+2, requestsTotal.With("/db/", "GET", "404").Value())
+	assert.Equal(t, beforeHealth+1, requestsTotal.With("/health", "GET", "200").Value())
+	assert.Equal(t, beforeUnmatched+1, requestsTotal.With("unmatched", "GET", "404").Value())
+	assert.Equal(t, 0.0, requestsInFlight.Value())
+}
+
+func TestCreateServer_Metrics(t *testing.T) {
+	s := CreateServer(0, http.NotFoundHandler()).(server)
+	rw := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(rw, httptest.NewRequest("GET", MetricsPath, nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "# TYPE http_requests_total counter")
+}
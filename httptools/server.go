@@ -1,14 +1,21 @@
 package httptools
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/Dimdim28/lab4-software-architecture/metrics"
 )
 
 type Server interface {
 	Start()
+	// Shutdown stops accepting connections and waits for the requests in
+	// flight until ctx is done.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -17,20 +24,48 @@ type server struct {
 
 func (s server) Start() {
 	go func() {
-		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			log.Println("Staring the HTTPS server...")
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Println("Staring the HTTP server...")
+			err = s.httpServer.ListenAndServe()
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
-func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+func (s server) Shutdown(ctx context.Context) error {
+	log.Println("Stopping the HTTP server...")
+	return s.httpServer.Shutdown(ctx)
+}
+
+// CreateServer returns a server of handler, which also serves the metrics
+// of the process at MetricsPath.
+func CreateServer(port int, handler http.Handler, opts ...Option) Server {
+	metricsHandler := metrics.Handler()
+	instrumented := instrument(handler)
+	// a ServeMux would clean the paths the balancer has to forward as they are
+	mux := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == MetricsPath && r.Method == http.MethodGet {
+			metricsHandler.ServeHTTP(rw, r)
+			return
+		}
+		instrumented.ServeHTTP(rw, r)
+	})
+	httpServer := &http.Server{
+		Addr:           fmt.Sprintf(":%d", port),
+		Handler:        mux,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	for _, opt := range opts {
+		opt(httpServer)
 	}
+	return server{httpServer: httpServer}
 }
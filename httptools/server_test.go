@@ -0,0 +1,61 @@
+package httptools
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		rw.Write([]byte("done"))
+	})
+	s := CreateServer(freePort(t), handler)
+	s.Start()
+	url := "http://127.0.0.1" + s.(server).httpServer.Addr + "/"
+
+	var resp *http.Response
+	var err error
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", "127.0.0.1"+s.(server).httpServer.Addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err = http.Get(url)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+
+	<-done
+	require.NoError(t, err, "the request in flight is finished")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "done", string(body))
+
+	_, err = http.Get(url)
+	assert.Error(t, err, "new connections are refused")
+}
@@ -0,0 +1,87 @@
+package httptools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Option configures a server created by CreateServer.
+type Option func(*http.Server)
+
+// WithTLS makes the server serve HTTPS, see LoadServerTLS.
+func WithTLS(config *tls.Config) Option {
+	return func(s *http.Server) {
+		s.TLSConfig = config
+	}
+}
+
+// LoadServerTLS loads the certificates of a server from PEM files, every
+// connection gets the one matching its SNI name or the first one. With a
+// client CA file the clients must present a certificate signed by one of
+// its CAs. It returns nil if there are no certificates.
+func LoadServerTLS(certFiles, keyFiles []string, clientCAFile string) (*tls.Config, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d certificates and %d keys", len(certFiles), len(keyFiles))
+	}
+	if len(certFiles) == 0 {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("client CA without a server certificate")
+		}
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	for i := range certFiles {
+		cert, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// LoadClientTLS returns the TLS config of a client trusting the CAs of
+// caFile, or the ones of the system if it is empty, and presenting the
+// certificate if there is one.
+func LoadClientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,72 @@
+package httptools
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Dimdim28/lab4-software-architecture/httptools/tlstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tlsClient(config *tls.Config) *http.Client {
+	return &http.Client{Timeout: time.Second, Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func TestLoadServerTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	cert, key := ca.Issue(t, "localhost")
+
+	config, err := LoadServerTLS(nil, nil, "")
+	assert.NoError(t, err)
+	assert.Nil(t, config, "TLS is disabled without certificates")
+
+	_, err = LoadServerTLS([]string{cert}, nil, "")
+	assert.Error(t, err)
+	_, err = LoadServerTLS(nil, nil, ca.File)
+	assert.Error(t, err)
+	_, err = LoadServerTLS([]string{cert}, []string{key}, cert+".missing")
+	assert.Error(t, err)
+	_, err = LoadClientTLS(key, "", "")
+	assert.Error(t, err, "a key isn't a certificate")
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	serverCert, serverKey := ca.Issue(t, "127.0.0.1")
+	clientCert, clientKey := ca.Issue(t, "client")
+
+	config, err := LoadServerTLS([]string{serverCert}, []string{serverKey}, ca.File)
+	require.NoError(t, err)
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	})
+	s := CreateServer(freePort(t), handler, WithTLS(config))
+	s.Start()
+	defer s.Shutdown(context.Background())
+	url := "https://127.0.0.1" + s.(server).httpServer.Addr + "/"
+
+	anonymous, err := LoadClientTLS(ca.File, "", "")
+	require.NoError(t, err)
+	authenticated, err := LoadClientTLS(ca.File, clientCert, clientKey)
+	require.NoError(t, err)
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = tlsClient(authenticated).Get(url)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "client", string(body))
+
+	_, err = tlsClient(anonymous).Get(url)
+	assert.Error(t, err, "clients without a certificate are refused")
+
+	_, err = tlsClient(&tls.Config{Certificates: authenticated.Certificates}).Get(url)
+	assert.Error(t, err, "the server certificate isn't trusted")
+}
@@ -0,0 +1,147 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const respAddress = "db:6379"
+
+// respClient is a minimal Redis protocol client, so the test doesn't rely on
+// the parser of the server it checks.
+type respClient struct {
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+func dialResp(address string) (*respClient, error) {
+	conn, err := net.DialTimeout("tcp", address, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &respClient{conn, bufio.NewReader(conn)}, nil
+}
+
+// do sends the command as an array of bulk strings and returns the reply:
+// a string for simple and bulk strings, nil for a null bulk string, an int64
+// for integers, []interface{} for arrays and an error for errors.
+func (c *respClient) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(3 * time.Second))
+	request := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		request += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, request); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+func (c *respClient) readReply() (interface{}, error) {
+	line, err := c.in.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return respError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.in, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = c.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", kind)
+}
+
+func TestResp(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+
+	c, err := dialResp(respAddress)
+	require.NoError(t, err)
+	defer c.conn.Close()
+
+	prefix := fmt.Sprintf("resp-test-%d:", time.Now().UnixNano())
+	check := func(expected interface{}, args ...string) {
+		reply, err := c.do(args...)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, reply, "%v", args)
+	}
+
+	check("PONG", "PING")
+	check("OK", "SET", prefix+"a", "value")
+	check("value", "GET", prefix+"a")
+	check(nil, "GET", prefix+"missing")
+	check(int64(10), "INCRBY", prefix+"counter", "10")
+	check("10", "GET", prefix+"counter")
+	check(int64(2), "EXISTS", prefix+"a", prefix+"counter", prefix+"missing")
+	check(respError("ERR value is not an integer or out of range"), "INCRBY", prefix+"a", "1")
+	check(int64(1), "EXPIRE", prefix+"a", "1")
+	check(int64(1), "DEL", prefix+"counter")
+	check(int64(0), "EXISTS", prefix+"counter")
+
+	time.Sleep(1100 * time.Millisecond)
+	check(nil, "GET", prefix+"a")
+
+	for i := 0; i < 30; i++ {
+		check("OK", "SET", fmt.Sprintf("%s%02d", prefix, i), "value")
+	}
+	var keys []interface{}
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", "7")
+		require.NoError(t, err)
+		page := reply.([]interface{})
+		keys = append(keys, page[1].([]interface{})...)
+		cursor = page[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Len(t, keys, 30)
+	assert.Equal(t, prefix+"00", keys[0])
+	assert.Equal(t, prefix+"29", keys[29])
+}
@@ -0,0 +1,213 @@
+// Package metrics implements counters, gauges and histograms exposed in the
+// Prometheus text format.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+func (v *value) store(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) add(f float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + f)
+		if atomic.CompareAndSwapUint64(&v.bits, old, updated) {
+			return
+		}
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v value
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increases the counter, negative deltas are ignored.
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.v.add(delta)
+	}
+}
+
+func (c *Counter) Value() float64 {
+	return c.v.load()
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	v value
+}
+
+func (g *Gauge) Set(f float64) {
+	g.v.store(f)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.v.load()
+}
+
+// DefBuckets are the default upper bounds of histogram buckets, tuned for
+// request latencies in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets with configurable upper bounds.
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64 // the last one counts values above all bounds
+	count       uint64
+	sum         value
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upperBounds: buckets,
+		counts:      make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(f float64) {
+	i := sort.SearchFloat64s(h.upperBounds, f)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(f)
+}
+
+// vec keeps the metrics of a family by their label values.
+type vec[T any] struct {
+	labels  []string
+	newItem func() *T
+	mu      sync.RWMutex
+	items   map[string]*T
+}
+
+func newVec[T any](labels []string, newItem func() *T) *vec[T] {
+	return &vec[T]{labels: labels, newItem: newItem, items: make(map[string]*T)}
+}
+
+// labelKey joins label values with a byte that is never valid in UTF-8.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic("metrics: wrong number of label values")
+	}
+	key := labelKey(values)
+	v.mu.RLock()
+	item, ok := v.items[key]
+	v.mu.RUnlock()
+	if ok {
+		return item
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if item, ok = v.items[key]; !ok {
+		item = v.newItem()
+		v.items[key] = item
+	}
+	return item
+}
+
+func (v *vec[T]) delete(values []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.items, labelKey(values))
+}
+
+// each calls fn for every item in the order of their label values.
+func (v *vec[T]) each(fn func(values []string, item *T)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.items))
+	for key := range v.items {
+		keys = append(keys, key)
+	}
+	items := make(map[string]*T, len(v.items))
+	for key, item := range v.items {
+		items[key] = item
+	}
+	v.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		var values []string
+		if len(v.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		fn(values, items[key])
+	}
+}
+
+// CounterVec is a family of counters partitioned by labels.
+type CounterVec struct {
+	*vec[Counter]
+}
+
+// With returns the counter with the given label values, creating it if needed.
+func (v CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+// Delete forgets the counter with the given label values.
+func (v CounterVec) Delete(values ...string) {
+	v.delete(values)
+}
+
+// GaugeVec is a family of gauges partitioned by labels.
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+func (v GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+
+func (v GaugeVec) Delete(values ...string) {
+	v.delete(values)
+}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct {
+	*vec[Histogram]
+}
+
+func (v HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+func (v HistogramVec) Delete(values ...string) {
+	v.delete(values)
+}
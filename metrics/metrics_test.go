@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Requests by code.", "code", "path")
+	requests.With("200", "/a").Add(3)
+	requests.With("500", `/"b"`).Inc()
+	requests.With("200", "/a").Add(-1)
+	r.NewGauge("in_flight", "").Set(2)
+	latency := r.NewHistogram("latency_seconds", "Latency\nin seconds.", []float64{1, 0.1})
+	for _, v := range []float64{0.05, 0.1, 0.5, 3} {
+		latency.Observe(v)
+	}
+	r.NewGaugeVecFunc("backend_up", "Backend health.", []string{"backend"}, func(observe func(float64, ...string)) {
+		observe(1, "server1")
+		observe(0, "server2")
+	})
+	r.NewCounterFunc("merges_total", "Merges.", func() float64 { return 7 })
+
+	var out strings.Builder
+	_, err := r.WriteTo(&out)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP backend_up Backend health.
+# TYPE backend_up gauge
+backend_up{backend="server1"} 1
+backend_up{backend="server2"} 0
+# TYPE in_flight gauge
+in_flight 2
+# HELP latency_seconds Latency\nin seconds.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.65
+latency_seconds_count 4
+# HELP merges_total Merges.
+# TYPE merges_total counter
+merges_total 7
+# HELP requests_total Requests by code.
+# TYPE requests_total counter
+requests_total{code="200",path="/a"} 3
+requests_total{code="500",path="/\"b\""} 1
+`, out.String())
+}
+
+func TestRegistry_Register(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("total", "")
+	assert.Panics(t, func() { r.NewGauge("total", "") }, "duplicate name")
+	assert.Panics(t, func() { r.NewGauge("bad-name", "") }, "invalid name")
+	assert.Panics(t, func() { r.NewHistogramVec("h", "", nil, "le") }, "reserved label")
+	assert.Panics(t, func() { r.NewCounterVec("c", "", "a").With("1", "2") }, "wrong label count")
+}
+
+func TestCounter_Concurrent(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("total", "", "worker")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("w").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, float64(8000), c.With("w").Value())
+
+	c.Delete("w")
+	rw := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, ContentType, rw.Header().Get("Content-Type"))
+	assert.Equal(t, "# TYPE total counter\n", rw.Body.String())
+}
@@ -0,0 +1,270 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// family is a registered metric written to the exposition.
+type family struct {
+	name, help, kind string
+	labels           []string
+	write            func(w *bufio.Writer, f *family)
+}
+
+// Registry keeps metrics and writes them in the Prometheus text format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// DefaultRegistry is used by the functions of the package and served by httptools.
+var DefaultRegistry = NewRegistry()
+
+// register adds the family, registering a name twice is a programming error.
+func (r *Registry) register(f *family) {
+	if !nameRe.MatchString(f.name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", f.name))
+	}
+	for _, label := range f.labels {
+		if !nameRe.MatchString(label) || strings.Contains(label, ":") || label == "le" {
+			panic(fmt.Sprintf("metrics: invalid label name %q", label))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[f.name]; ok {
+		panic(fmt.Sprintf("metrics: %s is already registered", f.name))
+	}
+	r.families[f.name] = f
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) CounterVec {
+	v := newVec(labels, func() *Counter { return new(Counter) })
+	r.register(&family{name, help, "counter", labels, func(w *bufio.Writer, f *family) {
+		v.each(func(values []string, c *Counter) {
+			writeSample(w, f.name, f.labels, values, c.Value())
+		})
+	}})
+	return CounterVec{v}
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	v := newVec(labels, func() *Gauge { return new(Gauge) })
+	r.register(&family{name, help, "gauge", labels, func(w *bufio.Writer, f *family) {
+		v.each(func(values []string, g *Gauge) {
+			writeSample(w, f.name, f.labels, values, g.Value())
+		})
+	}})
+	return GaugeVec{v}
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+// NewHistogramVec registers histograms with the given bucket upper bounds,
+// DefBuckets are used if there are none.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	v := newVec(labels, func() *Histogram { return newHistogram(buckets) })
+	r.register(&family{name, help, "histogram", labels, func(w *bufio.Writer, f *family) {
+		bucketLabels := append(append([]string(nil), f.labels...), "le")
+		v.each(func(values []string, h *Histogram) {
+			bucketValues := append(append([]string(nil), values...), "")
+			le := len(bucketValues) - 1
+			var cumulative uint64
+			for i, bound := range h.upperBounds {
+				cumulative += atomic.LoadUint64(&h.counts[i])
+				bucketValues[le] = formatFloat(bound)
+				writeSample(w, f.name+"_bucket", bucketLabels, bucketValues, float64(cumulative))
+			}
+			count := atomic.LoadUint64(&h.count)
+			bucketValues[le] = "+Inf"
+			writeSample(w, f.name+"_bucket", bucketLabels, bucketValues, float64(count))
+			writeSample(w, f.name+"_sum", f.labels, values, h.sum.load())
+			writeSample(w, f.name+"_count", f.labels, values, float64(count))
+		})
+	}})
+	return HistogramVec{v}
+}
+
+// NewGaugeFunc registers a gauge whose value is taken from fn on every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name, help, "gauge", nil, func(w *bufio.Writer, f *family) {
+		writeSample(w, f.name, nil, nil, fn())
+	}})
+}
+
+// NewCounterFunc registers a counter whose value is taken from fn on every scrape.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&family{name, help, "counter", nil, func(w *bufio.Writer, f *family) {
+		writeSample(w, f.name, nil, nil, fn())
+	}})
+}
+
+// NewGaugeVecFunc registers gauges reported by fn on every scrape, fn calls
+// observe once for every combination of label values.
+func (r *Registry) NewGaugeVecFunc(name, help string, labels []string, fn func(observe func(value float64, values ...string))) {
+	r.register(&family{name, help, "gauge", labels, func(w *bufio.Writer, f *family) {
+		fn(func(value float64, values ...string) {
+			if len(values) != len(f.labels) {
+				panic("metrics: wrong number of label values")
+			}
+			writeSample(w, f.name, f.labels, values, value)
+		})
+	}})
+}
+
+// WriteTo writes all metrics in the Prometheus text format ordered by name.
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	cw := &countingWriter{w: out}
+	w := bufio.NewWriter(cw)
+	for _, f := range families {
+		if f.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", f.name, helpReplacer.Replace(f.help))
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		f.write(w, f)
+	}
+	err := w.Flush()
+	return cw.n, err
+}
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", ContentType)
+		_, _ = r.WriteTo(rw)
+	})
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + labelReplacer.Replace(values[i]) + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Shortcuts registering metrics in DefaultRegistry.
+
+func NewCounter(name, help string) *Counter {
+	return DefaultRegistry.NewCounter(name, help)
+}
+
+func NewCounterVec(name, help string, labels ...string) CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help)
+}
+
+func NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	return DefaultRegistry.NewGaugeVec(name, help, labels...)
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, buckets)
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) {
+	DefaultRegistry.NewGaugeFunc(name, help, fn)
+}
+
+func NewCounterFunc(name, help string, fn func() float64) {
+	DefaultRegistry.NewCounterFunc(name, help, fn)
+}
+
+func NewGaugeVecFunc(name, help string, labels []string, fn func(observe func(value float64, values ...string))) {
+	DefaultRegistry.NewGaugeVecFunc(name, help, labels, fn)
+}
+
+// Handler serves the metrics of DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
@@ -4,12 +4,42 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
+var (
+	hooksMu     sync.Mutex
+	reloadHooks []func()
+)
+
+// OnReload registers fn to be called on SIGHUP while the process waits in
+// WaitForTerminationSignal. Without hooks SIGHUP terminates the process.
+func OnReload(fn func()) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+}
+
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
-	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-intChannel
+	intChannel := make(chan os.Signal, 1)
+	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(intChannel)
+
+	for sig := range intChannel {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		hooksMu.Lock()
+		hooks := append([]func(){}, reloadHooks...)
+		hooksMu.Unlock()
+		if len(hooks) == 0 {
+			break
+		}
+		log.Println("Reloading...")
+		for _, hook := range hooks {
+			hook()
+		}
+	}
 	log.Println("Shutting down...")
 }